@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"sendingemail/internal/config"
+	"sendingemail/internal/sender"
+)
+
+// runEnqueue queues a message for the running service to send on its next
+// tick, to check the whole queue to relay flow:
+//
+//	sendingemail enqueue --to a@example.com --subject Test --body Hello [--rule R01]
+func runEnqueue(args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	to := fs.String("to", "", "comma separated recipients")
+	subject := fs.String("subject", "", "subject of the message")
+	body := fs.String("body", "", "content of the message, HTML")
+	rule := fs.String("rule", "", "rule of the message, the defaults when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	zlog, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer zlog.Sync()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg, getEnvDuration("CONN_MAX_LIFETIME", 10*time.Minute))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	senderSvc, err := sender.NewService(ctx, cfg, db, zlog)
+	if err != nil {
+		return fmt.Errorf("failed to create sender service: %w", err)
+	}
+	defer senderSvc.Close()
+
+	txnNo, err := senderSvc.Enqueue(ctx, sender.EnqueueRequest{
+		To:      strings.Split(*to, ","),
+		Subject: *subject,
+		Body:    *body,
+		RuleID:  *rule,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(txnNo)
+	return nil
+}
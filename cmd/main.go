@@ -3,21 +3,30 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/go-co-op/gocron"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	hspb "sendingemail/genproto/go/http/v1"
+	"sendingemail/internal/config"
+	"sendingemail/internal/database"
+	"sendingemail/internal/scheduler"
 	"sendingemail/internal/sender"
+	"sendingemail/internal/server"
+	"sendingemail/internal/shutdown"
 
 	"github.com/labstack/echo/v4"
 	stdmw "github.com/labstack/echo/v4/middleware"
@@ -26,10 +35,21 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 
-	_ "github.com/denisenkom/go-mssqldb"
+	mssql "github.com/denisenkom/go-mssqldb"
 )
 
+var selftest = flag.Bool("selftest", false, "check the configuration, database and templates, then exit")
+
 func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "enqueue" {
+		if err := runEnqueue(flag.Args()[1:]); err != nil {
+			log.Fatalf("Failed to enqueue the message: %s", err)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		log.Fatalf("Failed to run the server: %s", err)
 	}
@@ -42,6 +62,28 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvInt returns the integer value of the environment variable key, or
+// fallback when it is unset or malformed.
+func getEnvInt(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// getEnvDuration returns the duration value of the environment variable key,
+// or fallback when it is unset or malformed.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
 type Album struct {
 	ID     int
 	Title  string
@@ -50,8 +92,10 @@ type Album struct {
 }
 
 func run() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Everything started below gets the signal-aware context, so a SIGTERM
+	// cancels the in-flight queries and sends, not only the HTTP server.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill, syscall.SIGTERM)
+	defer stop()
 
 	zlog, err := newLogger()
 	if err != nil {
@@ -60,20 +104,28 @@ func run() error {
 	defer zlog.Sync()
 	zap.ReplaceGlobals(zlog)
 
-	db, err := sql.Open(
-		"sqlserver",
-		fmt.Sprintf("sqlserver://%s:%s@%s:%s?database=%s&TrustServerCertificate=true",
-			os.Getenv("DB_USER"),
-			os.Getenv("DB_PASSWORD"),
-			os.Getenv("DB_HOST"),
-			os.Getenv("DB_PORT"),
-			os.Getenv("DB_NAME"),
-		),
-	)
+	// Components register their cleanup as they start and are torn down in
+	// reverse order. On an early return the deferred call does it, after a
+	// signal the select below does and this one has nothing left to run.
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	teardown := shutdown.New(zlog)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		teardown.Shutdown(ctx)
+	}()
+
+	cfg, err := config.Load()
 	if err != nil {
-		return fmt.Errorf("failed to create db connection: %w", err)
+		return err
 	}
-	defer db.Close()
+
+	connMaxLifetime := getEnvDuration("CONN_MAX_LIFETIME", 10*time.Minute)
+	db, err := openDB(cfg, connMaxLifetime)
+	if err != nil {
+		return err
+	}
+	teardown.RegisterCloser("database", db.Close)
 
 	if err := db.PingContext(ctx); err != nil {
 		return fmt.Errorf("failed to ping DB: %w", err)
@@ -82,49 +134,138 @@ func run() error {
 	db.SetConnMaxIdleTime(5)
 	db.SetMaxOpenConns(30)
 	db.SetConnMaxIdleTime(5 * time.Minute)
-	db.SetConnMaxLifetime(10 * time.Minute)
+	db.SetConnMaxLifetime(connMaxLifetime)
 
-	senderSvc, err := sender.NewService(ctx, db, zlog)
+	senderSvc, err := sender.NewService(ctx, cfg, db, zlog)
 	if err != nil {
 		return fmt.Errorf("failed to create sender service: %w", err)
 	}
+	teardown.RegisterCloser("sender", senderSvc.Close)
+	zlog.Info("Features loaded", senderSvc.Features().Fields()...)
+
+	if broken := senderSvc.ValidateTemplates(ctx); len(broken) > 0 {
+		for _, t := range broken {
+			zlog.Error("broken template", zap.String("template", t.Name), zap.String("error", t.Error))
+		}
+		return fmt.Errorf("%d template(s) failed to render", len(broken))
+	}
+
+	engaged, err := senderSvc.CheckKillSwitch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read the kill switch: %w", err)
+	}
+	if engaged {
+		zlog.Warn("Sending stopped by the kill switch")
+	}
+
+	if senderSvc.Features().AuthCheck {
+		// Advisory only, a misaligned domain still sends.
+		for _, r := range senderSvc.CheckSenderAuth(ctx) {
+			if len(r.Warnings) == 0 {
+				zlog.Info("Sender domain aligned", zap.String("domain", r.Domain), zap.String("spf", r.SPF))
+				continue
+			}
+			zlog.Warn("Sender domain misaligned",
+				zap.String("domain", r.Domain),
+				zap.String("spf", r.SPF),
+				zap.Bool("dmarc", r.DMARC),
+				zap.Strings("warnings", r.Warnings),
+			)
+		}
+	}
+
+	if *selftest {
+		zlog.Info("Self test passed")
+		return nil
+	}
+
+	if err := sender.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		return fmt.Errorf("failed to register sender metrics: %w", err)
+	}
+
+	sendInterval := sender.ParseSendInterval(os.Getenv("SEND_INTERVAL"))
+	zlog.Info("Send interval resolved", zap.Duration("interval", sendInterval))
+
+	schedules, err := sender.ParseRuleSchedules(os.Getenv("SEND_SCHEDULES"), sendInterval)
+	if err != nil {
+		return fmt.Errorf("failed to parse SEND_SCHEDULES: %w", err)
+	}
 
-	scheduled := gocron.NewScheduler(time.Local)
-	scheduled.Every(1).Minutes().Do(func() {
-		zlog.Info("Starting cron job to send emails")
-		senderSvc.Send(ctx)
+	idleAfter := getEnvInt("SEND_IDLE_AFTER", 0)
+	maxIdleInterval := getEnvDuration("SEND_IDLE_MAX_INTERVAL", 10*time.Minute)
+
+	scheduled := scheduler.New(zlog)
+	for _, sch := range schedules {
+		name := "send"
+		if len(sch.Filter.RuleIDs) > 0 {
+			name += ":" + strings.Join(sch.Filter.RuleIDs, ",")
+		}
+
+		err := scheduled.Schedule(ctx, scheduler.Job{
+			Name:     name,
+			Interval: sch.Interval,
+			Send: func(ctx context.Context) (*sender.SendResult, error) {
+				return senderSvc.SendRules(ctx, sch.Filter)
+			},
+			IdleAfter:       idleAfter,
+			MaxIdleInterval: maxIdleInterval,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// The reap job retries every REAPER_INTERVAL, a database still coming
+	// up must not keep the service down.
+	if _, err := senderSvc.ReapStuck(ctx); err != nil {
+		zlog.Warn("Failed to reap stuck messages at startup, leaving it to the reap job", zap.Error(err))
+	}
+	err = scheduled.ScheduleTask(ctx, "reap-stuck", getEnvDuration("REAPER_INTERVAL", 5*time.Minute), func(ctx context.Context) error {
+		_, err := senderSvc.ReapStuck(ctx)
+		return err
 	})
-	scheduled.StartAsync()
+	if err != nil {
+		return err
+	}
+
+	senderSvc.StartWarmUp(ctx)
+	scheduled.Start()
+	teardown.Register("scheduler", scheduled.Stop)
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HTTPErrorHandler = httpErr
 	e.Use(stdmws()...)
-	e.GET("/v1/healthz", func(c echo.Context) error {
-		ctx, cancel := context.WithTimeout(c.Request().Context(), 5*time.Second)
-		defer cancel()
-		if err := db.PingContext(ctx); err != nil {
-			return err
-		}
-		return c.JSON(http.StatusOK, echo.Map{
-			"code":    http.StatusOK,
-			"status":  "OK",
-			"message": "Available!",
-		})
-	})
+	health := server.NewHealth(
+		db,
+		getEnvDuration("HEALTH_READINESS_DB_TIMEOUT", getEnvDuration("HEALTH_DB_TIMEOUT", 5*time.Second)),
+		getEnv("HEALTH_FORMAT", server.HealthFormatJSON),
+	)
+	health.SetDBRetry(
+		getEnvInt("HEALTH_DB_PING_ATTEMPTS", 2),
+		getEnvDuration("HEALTH_DB_PING_BACKOFF", 200*time.Millisecond),
+	)
+	health.SetSMTPCheck(senderSvc.CheckSMTP, getEnvDuration("HEALTH_SMTP_TIMEOUT", 3*time.Second))
+	health.Register(e)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	admin := e.Group("/v1", server.AdminAuth(cfg.AdminToken))
+	server.NewHandler(senderSvc, getEnvDuration("SEND_REQUEST_TIMEOUT", 2*time.Minute)).Register(admin)
 
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- e.Start(fmt.Sprintf(":%s", getEnv("PORT", "8089")))
+		errChan <- e.Start(fmt.Sprintf(":%s", cfg.Port))
 	}()
-
-	ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, os.Kill, syscall.SIGTERM)
-	defer cancel()
+	teardown.Register("http", e.Shutdown)
 
 	select {
 	case <-ctx.Done():
 		zlog.Info("Shutting down the server...")
-		if err := e.Shutdown(ctx); err != nil {
+
+		// ctx is done by now, give the in-flight requests and the other
+		// components their own time to finish.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := teardown.Shutdown(shutdownCtx); err != nil {
 			return fmt.Errorf("failed to shutdown the server: %w", err)
 		}
 
@@ -139,6 +280,21 @@ func run() error {
 	return nil
 }
 
+// openDB opens the database of cfg, each connection living connMaxLifetime
+// give or take CONN_MAX_LIFETIME_JITTER percent.
+func openDB(cfg *config.Config, connMaxLifetime time.Duration) (*sql.DB, error) {
+	connector, err := mssql.NewConnector(cfg.DB.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create db connection: %w", err)
+	}
+
+	return sql.OpenDB(database.NewJitterConnector(
+		connector,
+		connMaxLifetime,
+		float64(getEnvInt("CONN_MAX_LIFETIME_JITTER", 10))/100,
+	)), nil
+}
+
 func newLogger() (*zap.Logger, error) {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "timestamp",
@@ -192,8 +348,57 @@ func stdmws() []echo.MiddlewareFunc {
 			MaxAge:           86400,
 		}),
 		stdmw.RateLimiter(stdmw.NewRateLimiterMemoryStore(10)),
-		stdmw.Secure(),
+		stdmw.SecureWithConfig(secureConfig()),
+	}
+}
+
+// secureConfig builds the Secure middleware config from the environment,
+// starting from echo's defaults so an empty environment behaves exactly
+// like stdmw.Secure().
+func secureConfig() stdmw.SecureConfig {
+	cfg := stdmw.DefaultSecureConfig
+
+	if v, ok := os.LookupEnv("SECURE_HSTS_MAX_AGE"); ok {
+		if maxAge, err := strconv.Atoi(v); err == nil && maxAge >= 0 {
+			cfg.HSTSMaxAge = maxAge
+		}
+	}
+	if v, ok := os.LookupEnv("SECURE_HSTS_EXCLUDE_SUBDOMAINS"); ok {
+		cfg.HSTSExcludeSubdomains, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("SECURE_CSP"); ok {
+		cfg.ContentSecurityPolicy = v
+	}
+	if v, ok := os.LookupEnv("SECURE_CSP_REPORT_ONLY"); ok {
+		cfg.CSPReportOnly, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("SECURE_X_FRAME_OPTIONS"); ok {
+		cfg.XFrameOptions = v
+	}
+	if v, ok := os.LookupEnv("SECURE_REFERRER_POLICY"); ok {
+		cfg.ReferrerPolicy = v
 	}
+
+	// The middleware only writes headers with a non-empty value, so
+	// disabling a header is a matter of clearing it.
+	for _, h := range strings.Split(os.Getenv("SECURE_DISABLE_HEADERS"), ",") {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "x-xss-protection":
+			cfg.XSSProtection = ""
+		case "x-content-type-options":
+			cfg.ContentTypeNosniff = ""
+		case "x-frame-options":
+			cfg.XFrameOptions = ""
+		case "strict-transport-security":
+			cfg.HSTSMaxAge = 0
+		case "content-security-policy":
+			cfg.ContentSecurityPolicy = ""
+		case "referrer-policy":
+			cfg.ReferrerPolicy = ""
+		}
+	}
+
+	return cfg
 }
 
 func httpErr(err error, c echo.Context) {
@@ -223,11 +428,9 @@ func httpErr(err error, c echo.Context) {
 		return
 	}
 
-	c.JSON(http.StatusInternalServerError, echo.Map{
-		"code":    500,
-		"status":  "INTERNAL_ERROR",
-		"message": "An internal error occurred",
-	})
+	hbp := httpStatusPbFromRPC(status.New(codes.Internal, "An internal error occurred"))
+	jsonb, _ := protojson.Marshal(hbp)
+	c.JSONBlob(int(hbp.Error.Code), jsonb)
 }
 
 func httpStatusPbFromRPC(s *status.Status) *hspb.Error {
@@ -0,0 +1,140 @@
+// Package config reads the settings the service cannot start without, once
+// at startup, so a misconfiguration fails fast instead of at the first send.
+// The optional tuning variables keep their defaults and are read where they
+// are used.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is the required configuration of the service.
+type Config struct {
+	DB   Database
+	SMTP SMTP
+	// MailFrom is the From of the messages whose rule has none.
+	MailFrom string
+	// Port is the port the HTTP server listens on.
+	Port string
+	// AdminToken is the bearer token of the admin routes, they are closed
+	// while it is empty.
+	AdminToken string
+}
+
+// Database is the SQL Server the queue lives in.
+type Database struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+}
+
+// DSN returns the connection string of d.
+func (d Database) DSN() string {
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(d.User, d.Password),
+		Host:     d.Host + ":" + d.Port,
+		RawQuery: url.Values{"database": {d.Name}, "TrustServerCertificate": {"true"}}.Encode(),
+	}
+	return u.String()
+}
+
+// SMTP is the default relay.
+type SMTP struct {
+	Host     string
+	Username string
+	Password string
+}
+
+// Load reads the configuration from the environment. Its error lists every
+// missing or invalid variable at once.
+func Load() (*Config, error) {
+	l := new(loader)
+	cfg := &Config{
+		DB: Database{
+			Host:     l.required("DB_HOST"),
+			Port:     l.port("DB_PORT", ""),
+			User:     l.required("DB_USER"),
+			Password: l.required("DB_PASSWORD"),
+			Name:     l.required("DB_NAME"),
+		},
+		SMTP: SMTP{
+			Host:     l.required("SMTP_HOST"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		},
+		MailFrom:   l.address("MAIL_FROM"),
+		Port:       l.port("PORT", "8089"),
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+	}
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loader collects the problems of the variables it reads.
+type loader struct {
+	missing []string
+	invalid []error
+}
+
+// required returns the value of key, recording it as missing when empty.
+func (l *loader) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		l.missing = append(l.missing, key)
+	}
+	return v
+}
+
+// address returns the required mail address in key, "Name <address>" or
+// bare.
+func (l *loader) address(key string) string {
+	v := l.required(key)
+	if v == "" {
+		return v
+	}
+
+	if _, err := mail.ParseAddress(v); err != nil {
+		l.invalid = append(l.invalid, fmt.Errorf("%s: %q is not a mail address", key, v))
+	}
+	return v
+}
+
+// port returns the TCP port in key, or fallback when it is unset. Without
+// fallback the variable is required.
+func (l *loader) port(key, fallback string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		if fallback == "" {
+			l.missing = append(l.missing, key)
+		}
+		return fallback
+	}
+
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+		l.invalid = append(l.invalid, fmt.Errorf("%s: %q is not a port", key, v))
+	}
+	return v
+}
+
+func (l *loader) err() error {
+	errs := make([]error, 0, len(l.invalid)+1)
+	if len(l.missing) > 0 {
+		errs = append(errs, fmt.Errorf("missing required environment variables: %s", strings.Join(l.missing, ", ")))
+	}
+	errs = append(errs, l.invalid...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand/v2"
+	"time"
+)
+
+// JitterConnector wraps a driver.Connector so that every connection gets
+// its own lifetime, picked at random between lifetime*(1-jitter) and
+// lifetime. Connections opened together, e.g. at startup, then expire at
+// different times instead of all reconnecting at once.
+//
+// An expired connection is reported invalid to database/sql, which closes
+// it instead of reusing it.
+type JitterConnector struct {
+	connector driver.Connector
+	lifetime  time.Duration
+	jitter    float64
+}
+
+// NewJitterConnector returns a JitterConnector. jitter is a fraction of
+// lifetime between 0 and 1.
+func NewJitterConnector(c driver.Connector, lifetime time.Duration, jitter float64) *JitterConnector {
+	jitter = min(max(jitter, 0), 1)
+
+	return &JitterConnector{
+		connector: c,
+		lifetime:  lifetime,
+		jitter:    jitter,
+	}
+}
+
+func (c *JitterConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := c.lifetime - time.Duration(float64(c.lifetime)*c.jitter*rand.Float64())
+	return &jitterConn{
+		Conn:    conn,
+		expires: time.Now().Add(lifetime),
+	}, nil
+}
+
+func (c *JitterConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// jitterConn forwards the optional driver interfaces implemented by the
+// wrapped connection, falling back to what database/sql expects when the
+// driver does not implement one.
+type jitterConn struct {
+	driver.Conn
+	expires time.Time
+}
+
+var (
+	_ driver.ConnBeginTx        = (*jitterConn)(nil)
+	_ driver.ConnPrepareContext = (*jitterConn)(nil)
+	_ driver.Pinger             = (*jitterConn)(nil)
+	_ driver.SessionResetter    = (*jitterConn)(nil)
+	_ driver.Validator          = (*jitterConn)(nil)
+	_ driver.NamedValueChecker  = (*jitterConn)(nil)
+)
+
+func (c *jitterConn) expired() bool {
+	return time.Now().After(c.expires)
+}
+
+func (c *jitterConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *jitterConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *jitterConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *jitterConn) ResetSession(ctx context.Context) error {
+	if c.expired() {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *jitterConn) IsValid() bool {
+	if c.expired() {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *jitterConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,311 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sendingemail/internal/sender"
+
+	"github.com/go-co-op/gocron"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// SendFunc runs one send tick.
+type SendFunc func(ctx context.Context) (*sender.SendResult, error)
+
+// Job is a send job run every Interval.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Send     SendFunc
+
+	// IdleAfter is the number of consecutive ticks without any message
+	// after which the job backs off, doubling its effective interval after
+	// each further empty tick up to MaxIdleInterval. The first tick finding
+	// messages brings it back to Interval. 0 disables the backoff.
+	IdleAfter       int
+	MaxIdleInterval time.Duration
+}
+
+// Scheduler runs the send jobs and logs their lifecycle. Every entry
+// carries component=scheduler and the job name, ticks also carry the
+// run_id the sender logs with.
+type Scheduler struct {
+	cron *gocron.Scheduler
+	zlog *zap.Logger
+	jobs int
+
+	// running counts the ticks and tasks in progress, for Stop to wait on.
+	// None starts once stopped is set.
+	mu      sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+func New(zlog *zap.Logger) *Scheduler {
+	return &Scheduler{
+		cron: gocron.NewScheduler(time.Local),
+		zlog: zlog.With(zap.String("component", "scheduler")),
+	}
+}
+
+// Schedule registers job. Ticks run with ctx.
+func (s *Scheduler) Schedule(ctx context.Context, job Job) error {
+	zlog := s.zlog.With(
+		zap.String("job", job.Name),
+		zap.Duration("interval", job.Interval),
+	)
+
+	// A tick outlasting the interval makes the next one skip instead of
+	// queueing up behind it.
+	var running atomic.Bool
+	guard := newTickGuard(job.Interval)
+	idle := newIdleBackoff(job.Interval, job.IdleAfter, job.MaxIdleInterval)
+	_, err := s.cron.Every(job.Interval).Do(func() {
+		if !running.CompareAndSwap(false, true) {
+			zlog.Warn("tick skipped, previous tick still running")
+			return
+		}
+		defer running.Store(false)
+		if !s.begin() {
+			return
+		}
+		defer s.running.Done()
+
+		run, gap := guard.allow(time.Now())
+		if !run {
+			zlog.Warn("tick skipped, previous tick ran too recently", zap.Duration("since_last", gap))
+			return
+		}
+		if gap > 2*job.Interval {
+			zlog.Warn("tick resumed after a long gap, running a single catch-up", zap.Duration("gap", gap))
+		}
+
+		if !idle.due(time.Now()) {
+			zlog.Debug("tick skipped, backing off while the queue is empty")
+			return
+		}
+
+		res, err := s.tick(ctx, zlog, job)
+		if err != nil {
+			return
+		}
+		if wait, changed := idle.record(time.Now(), res.Listed); changed {
+			if wait == 0 {
+				zlog.Info("messages found, polling back at the base interval")
+			} else {
+				zlog.Info("queue idle, backing off", zap.Duration("effective_interval", wait))
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule job %q: %w", job.Name, err)
+	}
+
+	s.jobs++
+	zlog.Info("job scheduled")
+	return nil
+}
+
+// ScheduleTask registers a maintenance task run every interval. Failures
+// are logged.
+func (s *Scheduler) ScheduleTask(ctx context.Context, name string, interval time.Duration, task func(ctx context.Context) error) error {
+	zlog := s.zlog.With(
+		zap.String("job", name),
+		zap.Duration("interval", interval),
+	)
+
+	var running atomic.Bool
+	_, err := s.cron.Every(interval).Do(func() {
+		if !running.CompareAndSwap(false, true) {
+			zlog.Warn("task skipped, previous run still running")
+			return
+		}
+		defer running.Store(false)
+		if !s.begin() {
+			return
+		}
+		defer s.running.Done()
+
+		if err := task(ctx); err != nil {
+			zlog.Error("task failed", zap.Error(err))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule task %q: %w", name, err)
+	}
+
+	s.jobs++
+	zlog.Info("task scheduled")
+	return nil
+}
+
+// tick runs job once and returns its result, never nil.
+func (s *Scheduler) tick(ctx context.Context, zlog *zap.Logger, job Job) (*sender.SendResult, error) {
+	runID := uuid.NewString()
+	zlog = zlog.With(zap.String("run_id", runID))
+
+	zlog.Info("tick started")
+	start := time.Now()
+
+	res, err := job.Send(sender.WithRunID(ctx, runID))
+	if res == nil {
+		res = new(sender.SendResult)
+	}
+
+	fields := append(res.Fields(), zap.Duration("duration", time.Since(start)))
+	if err != nil {
+		zlog.Error("tick finished", append(fields, zap.String("result", "error"), zap.Error(err))...)
+		return res, err
+	}
+	zlog.Info("tick finished", append(fields, zap.String("result", "ok"))...)
+	return res, nil
+}
+
+// Start starts running the jobs in the background.
+func (s *Scheduler) Start() {
+	s.cron.StartAsync()
+	s.zlog.Info("scheduler started", zap.Int("jobs", s.jobs))
+}
+
+// begin counts a tick or task in, unless the scheduler is stopping.
+func (s *Scheduler) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.running.Add(1)
+	return true
+}
+
+// Stop stops the scheduler, then waits for the running ticks and tasks to
+// finish so a send is not cut off between the relay and its status
+// update. It gives up once ctx is done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.cron.Stop()
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	drained := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.zlog.Info("scheduler stopped", zap.Duration("drain", time.Since(start)))
+		return nil
+	case <-ctx.Done():
+		s.zlog.Warn("scheduler stopped before the running ticks finished", zap.Duration("drain", time.Since(start)))
+		return fmt.Errorf("failed to drain the running ticks: %w", ctx.Err())
+	}
+}
+
+// tickGuard collapses a burst of ticks into one. After the host suspends
+// and resumes, the missed ticks can fire back to back: only the first one
+// runs, the ones following it within half an interval are dropped.
+type tickGuard struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newTickGuard(interval time.Duration) *tickGuard {
+	return &tickGuard{interval: interval}
+}
+
+// allow reports whether the tick firing at now should run, and the time
+// elapsed since the last tick that ran. Wall clock time is used on purpose:
+// the monotonic clock does not advance while the host is suspended.
+func (g *tickGuard) allow(now time.Time) (bool, time.Duration) {
+	now = now.Round(0)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.last.IsZero() {
+		g.last = now
+		return true, 0
+	}
+
+	gap := now.Sub(g.last)
+	if gap < g.interval/2 {
+		return false, gap
+	}
+
+	g.last = now
+	return true, gap
+}
+
+// idleBackoff stretches the interval of a job while its queue stays empty,
+// sparing the database a pd_wiseSendEmail run every tick during quiet
+// periods. The job still fires every interval, the ticks before next are
+// skipped.
+type idleBackoff struct {
+	interval time.Duration
+	after    int
+	max      time.Duration
+
+	mu    sync.Mutex
+	empty int
+	wait  time.Duration
+	next  time.Time
+}
+
+// newIdleBackoff returns the backoff of a job, one that never skips a tick
+// when after is 0 or maxInterval is not above interval.
+func newIdleBackoff(interval time.Duration, after int, maxInterval time.Duration) *idleBackoff {
+	return &idleBackoff{interval: interval, after: after, max: maxInterval}
+}
+
+func (b *idleBackoff) enabled() bool {
+	return b.after > 0 && b.max > b.interval
+}
+
+// due reports whether the tick firing at now should run.
+func (b *idleBackoff) due(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.next.IsZero() || !now.Before(b.next)
+}
+
+// record counts a tick that ran at now and picked listed messages. It
+// returns the effective interval, 0 for the base one, and whether the tick
+// changed it.
+func (b *idleBackoff) record(now time.Time, listed int) (time.Duration, bool) {
+	if !b.enabled() {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if listed > 0 {
+		changed := b.wait > 0
+		b.empty, b.wait, b.next = 0, 0, time.Time{}
+		return 0, changed
+	}
+
+	b.empty++
+	if b.empty < b.after {
+		return 0, false
+	}
+	wait := min(max(2*b.wait, 2*b.interval), b.max)
+	changed := wait != b.wait
+	b.wait = wait
+	// The ticks keep firing on the base interval: half of one is left as
+	// slack so the tick landing on the effective interval runs.
+	b.next = now.Add(wait - b.interval/2)
+	return wait, changed
+}
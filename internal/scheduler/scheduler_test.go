@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"sendingemail/internal/sender"
+)
+
+func TestScheduleSkipsOverlappingTicks(t *testing.T) {
+	s := New(zap.NewNop())
+
+	var (
+		mu         sync.Mutex
+		ticks      int
+		active     int
+		maxActive  int
+		firstBlock = make(chan struct{})
+	)
+	send := func(context.Context) (*sender.SendResult, error) {
+		mu.Lock()
+		ticks++
+		first := ticks == 1
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+
+		if first {
+			// Outlasts several intervals.
+			<-firstBlock
+		}
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return new(sender.SendResult), nil
+	}
+
+	err := s.Schedule(context.Background(), Job{Name: "send", Interval: 10 * time.Millisecond, Send: send})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	time.Sleep(100 * time.Millisecond)
+	close(firstBlock)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive != 1 {
+		t.Errorf("%d ticks ran at the same time, want 1", maxActive)
+	}
+	if ticks < 2 {
+		t.Errorf("%d ticks ran, want the job to go on once the slow tick finished", ticks)
+	}
+}
+
+func TestTickGuardRunsSingleCatchUp(t *testing.T) {
+	interval := 10 * time.Second
+	g := newTickGuard(interval)
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		wantRun bool
+		wantGap time.Duration
+	}{
+		{name: "first tick", at: start, wantRun: true},
+		{name: "tick after resume", at: start.Add(time.Hour), wantRun: true, wantGap: time.Hour},
+		{name: "missed tick fired back to back", at: start.Add(time.Hour + time.Millisecond), wantRun: false, wantGap: time.Millisecond},
+		{name: "missed tick fired later", at: start.Add(time.Hour + interval/4), wantRun: false, wantGap: interval / 4},
+		{name: "next regular tick", at: start.Add(time.Hour + interval), wantRun: true, wantGap: interval},
+	}
+	for _, tt := range tests {
+		run, gap := g.allow(tt.at)
+		if run != tt.wantRun || gap != tt.wantGap {
+			t.Errorf("%s: allow() = %v, %v, want %v, %v", tt.name, run, gap, tt.wantRun, tt.wantGap)
+		}
+	}
+}
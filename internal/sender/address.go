@@ -0,0 +1,109 @@
+package sender
+
+import (
+	netmail "net/mail"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// addressNormalizer cleans up the recipient addresses read from the queue,
+// which are typed by hand and often carry spaces, brackets or mixed case.
+type addressNormalizer struct {
+	// aggressive also strips stray quotes and punctuation around the
+	// address, removes inner whitespace and lowercases the local part.
+	aggressive bool
+}
+
+// normalize trims addr, strips the angle brackets around a bare address and
+// lowercases its domain. Addresses with a display name and group codes are
+// only trimmed.
+func (n addressNormalizer) normalize(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if n.aggressive {
+		addr = strings.Trim(addr, " \t\r\n\"',;:.")
+		addr = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, addr)
+	}
+
+	if strings.HasPrefix(addr, "<") && strings.HasSuffix(addr, ">") {
+		addr = strings.TrimSpace(addr[1 : len(addr)-1])
+	}
+	if strings.ContainsAny(addr, "<>") || strings.HasPrefix(addr, "@") {
+		return addr
+	}
+
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return addr
+	}
+	if n.aggressive {
+		return strings.ToLower(addr)
+	}
+	return addr[:at] + strings.ToLower(addr[at:])
+}
+
+// normalizeAll normalizes addrs, dropping the empty and repeated ones.
+func (n addressNormalizer) normalizeAll(addrs []string) []string {
+	out := make([]string, 0, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		a = n.normalize(a)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+// splitValid splits addrs into the ones net/mail parses, bare or with a
+// display name, and the others.
+func splitValid(addrs []string) (valid, invalid []string) {
+	valid = make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if _, err := netmail.ParseAddress(a); err != nil {
+			invalid = append(invalid, a)
+			continue
+		}
+		valid = append(valid, a)
+	}
+	return valid, invalid
+}
+
+// invalidRecipientsError is returned by prepare for a message whose every
+// recipient is invalid. It cannot be sent until its addresses are fixed.
+type invalidRecipientsError struct {
+	addresses []string
+}
+
+func (e *invalidRecipientsError) Error() string {
+	return "no valid recipient, invalid: " + strings.Join(e.addresses, ", ")
+}
+
+// dropInvalidRecipients removes the recipients of msg that are not valid
+// addresses, so a typo fails neither the message nor its batch, and
+// returns them.
+func (s *Service) dropInvalidRecipients(msg *Message) []string {
+	var invalid, dropped []string
+	msg.ToAddresses, invalid = splitValid(msg.ToAddresses)
+	dropped = append(dropped, invalid...)
+	msg.CCAddresses, invalid = splitValid(msg.CCAddresses)
+	dropped = append(dropped, invalid...)
+	msg.BCCAddresses, invalid = splitValid(msg.BCCAddresses)
+	dropped = append(dropped, invalid...)
+
+	if len(dropped) > 0 {
+		s.zlog.Warn("dropping invalid recipients",
+			zap.String("txnno", msg.TxnNo),
+			zap.Strings("recipients", dropped),
+		)
+	}
+	return dropped
+}
@@ -0,0 +1,229 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+	// Path is the file read for Content when the attachment is stored
+	// without one.
+	Path string
+}
+
+// attachmentFetcher downloads the attachments referenced by URL.
+type attachmentFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func newAttachmentFetcher(client *http.Client, maxBytes int64) *attachmentFetcher {
+	return &attachmentFetcher{client: client, maxBytes: maxBytes}
+}
+
+// newAttachmentClient returns the HTTP client used to fetch attachments. It
+// goes through the proxy configured by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newAttachmentClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// fetch downloads the attachment at rawURL, refusing bodies larger than
+// maxBytes.
+func (f *attachmentFetcher) fetch(ctx context.Context, rawURL string) (*Attachment, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid attachment url %q", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attachment request: %w", err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attachment %q: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch attachment %q: unexpected status %s", rawURL, resp.Status)
+	}
+	if f.maxBytes > 0 && resp.ContentLength > f.maxBytes {
+		return nil, fmt.Errorf("attachment %q is %d bytes, over the %d bytes limit", rawURL, resp.ContentLength, f.maxBytes)
+	}
+
+	r := io.Reader(resp.Body)
+	if f.maxBytes > 0 {
+		r = io.LimitReader(resp.Body, f.maxBytes+1)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment %q: %w", rawURL, err)
+	}
+	if f.maxBytes > 0 && int64(len(content)) > f.maxBytes {
+		return nil, fmt.Errorf("attachment %q is over the %d bytes limit", rawURL, f.maxBytes)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "attachment"
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	return &Attachment{
+		Name:        name,
+		ContentType: contentType,
+		Content:     content,
+	}, nil
+}
+
+// defaultAttachmentType is the type of the attachments whose type is
+// neither stored nor detected.
+const defaultAttachmentType = "application/octet-stream"
+
+// contentType returns the stored type of a. Without one, it is guessed
+// from the extension of the name, then from the first bytes of the
+// content when detect is set.
+func (a Attachment) contentType(detect bool) string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if !detect {
+		return defaultAttachmentType
+	}
+
+	if t := mime.TypeByExtension(path.Ext(a.Name)); t != "" {
+		if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+			return mediaType
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(a.Content))
+	if mediaType == "" {
+		return defaultAttachmentType
+	}
+	return mediaType
+}
+
+// readAttachmentFiles reads the content of the attachments of msg stored
+// with a path. A missing file is logged and left out, the message is sent
+// without it.
+func (s *Service) readAttachmentFiles(msg *Message) error {
+	attachments := msg.Attachments[:0]
+	for _, a := range msg.Attachments {
+		if a.Content != nil || a.Path == "" {
+			attachments = append(attachments, a)
+			continue
+		}
+
+		content, err := os.ReadFile(a.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.zlog.Warn("attachment file not found, sending without it",
+				zap.String("txnno", msg.TxnNo),
+				zap.String("name", a.Name),
+				zap.String("path", a.Path),
+			)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read attachment %q: %w", a.Path, err)
+		}
+		if s.fetcher.maxBytes > 0 && int64(len(content)) > s.fetcher.maxBytes {
+			return fmt.Errorf("attachment %q is over the %d bytes limit", a.Path, s.fetcher.maxBytes)
+		}
+
+		a.Content = content
+		if a.Name == "" {
+			a.Name = filepath.Base(a.Path)
+		}
+		attachments = append(attachments, a)
+	}
+	msg.Attachments = attachments
+	return nil
+}
+
+// attachmentQueryChunk is the most txnNos looked up by one attachment
+// query, well under the 2100 parameters of SQL Server.
+const attachmentQueryChunk = 500
+
+// loadAttachments sets the attachments stored in dbo.tb_emailAttachment
+// on ms.
+func (db *sqlStore) loadAttachments(ctx context.Context, ms []*Message) error {
+	byTxnNo := make(map[string][]*Message, len(ms))
+	txnNos := make([]string, 0, len(ms))
+	for _, m := range ms {
+		if _, ok := byTxnNo[m.TxnNo]; !ok {
+			txnNos = append(txnNos, m.TxnNo)
+		}
+		byTxnNo[m.TxnNo] = append(byTxnNo[m.TxnNo], m)
+	}
+
+	for chunk := range slices.Chunk(txnNos, attachmentQueryChunk) {
+		q, args := db.sb.Select("txnno", "filename", "contenttype", "content", "filepath").
+			From("dbo.tb_emailAttachment").
+			Where(sq.Eq{"txnno": chunk}).
+			OrderBy("txnno", "attachmentid").
+			MustSql()
+
+		if err := db.scanAttachments(ctx, q, args, byTxnNo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqlStore) scanAttachments(ctx context.Context, q string, args []any, byTxnNo map[string][]*Message) error {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query tb_emailAttachment: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var txnNo string
+		var name, contentType, path sql.NullString
+		var content []byte
+		if err := rows.Scan(&txnNo, &name, &contentType, &content, &path); err != nil {
+			return fmt.Errorf("failed to scan tb_emailAttachment: %w", err)
+		}
+
+		a := Attachment{
+			Name:        name.String,
+			ContentType: contentType.String,
+			Content:     content,
+			Path:        path.String,
+		}
+		for _, m := range byTxnNo[txnNo] {
+			m.Attachments = append(m.Attachments, a)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to scan tb_emailAttachment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package sender
+
+import (
+	"sync"
+	"time"
+)
+
+// autoPause stops sending when the failure rate over a rolling window goes
+// above threshold. Unlike a transient failure, a pause is only lifted by an
+// operator calling resume, so a broken batch does not keep hitting
+// recipients and the relay reputation.
+type autoPause struct {
+	threshold  float64
+	window     time.Duration
+	minSamples int
+
+	mu       sync.Mutex
+	outcomes []sendOutcome
+	paused   bool
+	pausedAt time.Time
+}
+
+type sendOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// AutoPauseStatus describes whether sending is auto-paused.
+type AutoPauseStatus struct {
+	Paused   bool
+	PausedAt time.Time
+}
+
+func newAutoPause(threshold float64, window time.Duration, minSamples int) *autoPause {
+	return &autoPause{
+		threshold:  threshold,
+		window:     window,
+		minSamples: minSamples,
+	}
+}
+
+// record adds sent successes and failed failures to the window and
+// reports whether they tripped the pause.
+func (a *autoPause) record(now time.Time, sent, failed int) (bool, float64) {
+	if a.threshold <= 0 {
+		return false, 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := 0; i < sent; i++ {
+		a.outcomes = append(a.outcomes, sendOutcome{at: now})
+	}
+	for i := 0; i < failed; i++ {
+		a.outcomes = append(a.outcomes, sendOutcome{at: now, failed: true})
+	}
+
+	cutoff := now.Add(-a.window)
+	n := 0
+	for n < len(a.outcomes) && a.outcomes[n].at.Before(cutoff) {
+		n++
+	}
+	a.outcomes = a.outcomes[n:]
+
+	if a.paused || len(a.outcomes) < a.minSamples {
+		return false, 0
+	}
+
+	failures := 0
+	for _, o := range a.outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+
+	rate := float64(failures) / float64(len(a.outcomes))
+	if rate <= a.threshold {
+		return false, rate
+	}
+
+	a.paused = true
+	a.pausedAt = now
+	return true, rate
+}
+
+func (a *autoPause) status() AutoPauseStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return AutoPauseStatus{Paused: a.paused, PausedAt: a.pausedAt}
+}
+
+// resume lifts the pause and forgets the outcomes that caused it.
+func (a *autoPause) resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.paused = false
+	a.pausedAt = time.Time{}
+	a.outcomes = nil
+}
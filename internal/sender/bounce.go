@@ -0,0 +1,165 @@
+package sender
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Bounce is a delivery failure reported by the relay.
+type Bounce struct {
+	// TxnNo is the message that bounced, when known.
+	TxnNo     string `json:"txn_no"`
+	Recipient string `json:"recipient"`
+	// Status is the enhanced status code, e.g. "5.1.1", or the SMTP reply
+	// code, e.g. "550".
+	Status     string `json:"status"`
+	Diagnostic string `json:"diagnostic"`
+}
+
+// BounceClass tells whether a bounce is permanent.
+type BounceClass string
+
+const (
+	// BounceHard is a permanent failure: the address is suppressed.
+	BounceHard BounceClass = "hard"
+	// BounceSoft is a temporary failure: the message is sent again until
+	// it runs out of attempts.
+	BounceSoft BounceClass = "soft"
+)
+
+// hardBounceDiagnostics match the diagnostics of a mailbox that does not
+// exist, for bounces without a usable status.
+var hardBounceDiagnostics = regexp.MustCompile(`(?i)user unknown|unknown user|no such user|does not exist|invalid recipient|recipient rejected|mailbox unavailable|address rejected`)
+
+// classifyBounce tells a hard bounce from a soft one. 5.x.x statuses are
+// hard except the ones a later attempt may get through, like a full
+// mailbox or a routing problem, 4.x.x statuses are soft.
+func classifyBounce(b Bounce) BounceClass {
+	st := strings.TrimSpace(b.Status)
+	switch {
+	case strings.HasPrefix(st, "5.2.2"), strings.HasPrefix(st, "5.4."), st == "552":
+		return BounceSoft
+	case strings.HasPrefix(st, "5"):
+		return BounceHard
+	case strings.HasPrefix(st, "4"):
+		return BounceSoft
+	case hardBounceDiagnostics.MatchString(b.Diagnostic):
+		return BounceHard
+	default:
+		return BounceSoft
+	}
+}
+
+// HandleBounce suppresses the recipient of a hard bounce and sends the
+// message of a soft bounce again, to the bounced recipient alone and with
+// the queue of today, until it used all its attempts.
+func (s *Service) HandleBounce(ctx context.Context, b Bounce) (BounceClass, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "HandleBounce"),
+		zap.String("txnno", b.TxnNo),
+		zap.String("recipient", b.Recipient),
+		zap.String("status", b.Status),
+	)
+
+	if b.Recipient == "" {
+		return "", status.Error(codes.InvalidArgument, "Recipient is required.")
+	}
+
+	class := classifyBounce(b)
+	s.publish(ctx, zlog, BusEvent{
+		Type:      EventBounced,
+		TxnNo:     b.TxnNo,
+		Recipient: b.Recipient,
+		Class:     class,
+		Detail:    strings.TrimSpace(b.Status + " " + b.Diagnostic),
+		At:        time.Now(),
+	})
+
+	switch class {
+	case BounceHard:
+		if !s.features.Suppression {
+			zlog.Warn("hard bounce not suppressed, the suppression feature is off")
+			break
+		}
+		reason := strings.TrimSpace(b.Status + " " + b.Diagnostic)
+		if err := s.suppressions.Suppress(ctx, b.Recipient, reason); err != nil {
+			zlog.Error("failed to suppress recipient", zap.Error(err))
+			return class, err
+		}
+		zlog.Warn("recipient suppressed after hard bounce", zap.String("reason", reason))
+
+	case BounceSoft:
+		if b.TxnNo == "" {
+			zlog.Info("soft bounce without message, nothing to retry")
+			break
+		}
+		msg, err := s.store.Get(ctx, b.TxnNo)
+		if err != nil {
+			zlog.Error("failed to get bounced message", zap.Error(err))
+			return class, err
+		}
+		if msg == nil {
+			zlog.Warn("soft bounce of an unknown message, nothing to retry")
+			break
+		}
+		ok, err := s.sentTo(ctx, msg, b.Recipient)
+		if err != nil {
+			zlog.Error("failed to resolve the recipients of the bounced message", zap.Error(err))
+			return class, err
+		}
+		if !ok {
+			// The message is only ever sent again to one of its own
+			// recipients.
+			zlog.Warn("soft bounce of a recipient the message was not sent to, nothing to retry")
+			break
+		}
+
+		retried, err := s.store.RetryBounced(ctx, b.TxnNo, b.Recipient, capDay(time.Now()), s.maxAttempts)
+		if err != nil {
+			zlog.Error("failed to retry bounced message", zap.Error(err))
+			return class, err
+		}
+		detail := strings.TrimSpace(b.Status + " " + b.Diagnostic)
+		if retried {
+			zlog.Info("message requeued after soft bounce")
+			s.recordEvents(ctx, zlog, []Event{{TxnNo: b.TxnNo, Type: EventQueued, Detail: detail, At: time.Now()}})
+		} else {
+			zlog.Warn("message failed after soft bounce, no attempt left")
+			s.recordEvents(ctx, zlog, []Event{{TxnNo: b.TxnNo, Type: EventFailed, Detail: detail, At: time.Now()}})
+		}
+	}
+	return class, nil
+}
+
+// sentTo reports whether msg went to addr, one of its recipients, a member
+// of one of its group codes or a CC recipient of its rule.
+func (s *Service) sentTo(ctx context.Context, msg *Message, addr string) (bool, error) {
+	to, _, err := s.resolver.Resolve(ctx, msg.ToAddresses)
+	if err != nil {
+		return false, err
+	}
+	bcc, _, err := s.resolver.Resolve(ctx, msg.BCCAddresses)
+	if err != nil {
+		return false, err
+	}
+
+	recipients := slices.Concat(to, bcc)
+	if msg.Amount != nil {
+		recipients = append(recipients, s.rules.Load().resolve(msg.RuleID).thresholdCC(*msg.Amount)...)
+	}
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	for _, r := range recipients {
+		if strings.ToLower(strings.TrimSpace(r)) == addr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,321 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	netmail "net/mail"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/mail.v2"
+)
+
+// panicError is returned by prepare when building a message panicked.
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// prepare resolves the recipients of msg and builds the mail to send. A
+// panic along the way is recovered and returned as a *panicError so that a
+// single malformed message cannot take the whole run down.
+func (s *Service) prepare(ctx context.Context, msg *Message) (m *mail.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &panicError{value: r, stack: debug.Stack()}
+		}
+	}()
+
+	msg.rule = s.rules.Load().resolvePriority(msg.RuleID, msg.Priority)
+	if msg.Locale == "" {
+		msg.Locale = s.locale
+	}
+	if err := s.renderTemplate(msg); err != nil {
+		return nil, err
+	}
+	if s.features.Placeholders {
+		expandPlaceholders(msg)
+	}
+	if s.features.TraceHeaders {
+		msg.trace = traceContextOf(ctx)
+	}
+	if err := s.applyFrom(msg); err != nil {
+		return nil, err
+	}
+	s.applyReplyTo(msg)
+	if msg.Amount != nil {
+		for _, cc := range msg.rule.thresholdCC(*msg.Amount) {
+			if !slices.Contains(msg.CCAddresses, cc) {
+				msg.CCAddresses = append(msg.CCAddresses, cc)
+			}
+		}
+	}
+
+	if msg.rule.Category == CategoryBulk && msg.rule.ListUnsubscribe == "" {
+		if s.features.BlockMissingUnsubscribe {
+			return nil, fmt.Errorf("bulk rule %q has no list_unsubscribe", msg.RuleID)
+		}
+		s.zlog.Warn("bulk message without unsubscribe header",
+			zap.String("txnno", msg.TxnNo),
+			zap.String("rule_id", msg.RuleID),
+		)
+	}
+
+	if err := s.resolveRecipients(ctx, msg); err != nil {
+		return nil, err
+	}
+	msg.ToAddresses = s.addresses.normalizeAll(msg.ToAddresses)
+	msg.CCAddresses = s.addresses.normalizeAll(msg.CCAddresses)
+	msg.BCCAddresses = s.addresses.normalizeAll(msg.BCCAddresses)
+	invalid := s.dropInvalidRecipients(msg)
+	if !s.hasRecipients(msg) {
+		if len(invalid) > 0 {
+			return nil, &invalidRecipientsError{addresses: invalid}
+		}
+		return nil, errors.New("no recipient left after normalizing the addresses")
+	}
+
+	if err := s.dropSuppressed(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	if s.mx != nil {
+		if err := s.checkRecipientDomains(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	if n := len(recipientsOf(msg)); s.maxRecipients > 0 && n > s.maxRecipients && !s.features.SplitRecipients {
+		return nil, fmt.Errorf("too many recipients: %d, over the %d limit", n, s.maxRecipients)
+	}
+
+	if err := s.readAttachmentFiles(msg); err != nil {
+		return nil, err
+	}
+	if msg.AttachmentURL != "" {
+		a, err := s.fetcher.fetch(ctx, msg.AttachmentURL)
+		if err != nil {
+			return nil, err
+		}
+		msg.Attachments = append(msg.Attachments, *a)
+	}
+
+	if size := messageSize(msg); s.maxMessageSize > 0 && size > s.maxMessageSize {
+		s.zlog.Warn("message too large",
+			zap.String("txnno", msg.TxnNo),
+			zap.Int("size", size),
+			zap.Int("limit", s.maxMessageSize),
+		)
+		return nil, fmt.Errorf("message too large: %d bytes, over the %d bytes limit", size, s.maxMessageSize)
+	}
+
+	return s.build(msg)
+}
+
+// xPriority maps an importance to its X-Priority header value.
+var xPriority = map[string]string{
+	PriorityHigh:   "1 (Highest)",
+	PriorityNormal: "3 (Normal)",
+	PriorityLow:    "5 (Lowest)",
+}
+
+// recipientsOf returns the To, Cc and Bcc recipients of msg, in order.
+func recipientsOf(msg *Message) []string {
+	return slices.Concat(msg.ToAddresses, msg.CCAddresses, msg.BCCAddresses)
+}
+
+// undisclosedRecipients is the To header of the messages sent to BCC
+// recipients only.
+const undisclosedRecipients = "undisclosed-recipients:;"
+
+// envelopes splits the recipients of msg into envelopes of at most
+// maxRecipients each, keeping their order. It returns nil when they fit in
+// one and the headers can be trusted for the envelope, which is not the
+// case of a BCC-only message. Every envelope gets the same mail, so the To
+// and Cc headers still list everyone.
+func (s *Service) envelopes(msg *Message) [][]string {
+	rcpts := recipientsOf(msg)
+	fits := s.maxRecipients <= 0 || len(rcpts) <= s.maxRecipients
+	if fits && len(msg.ToAddresses) > 0 {
+		return nil
+	}
+	if fits {
+		return [][]string{rcpts}
+	}
+	return slices.Collect(slices.Chunk(rcpts, s.maxRecipients))
+}
+
+// messageSize returns the size of the content and attachments of msg,
+// before encoding.
+func messageSize(msg *Message) int {
+	size := len(msg.Content)
+	for _, a := range msg.Attachments {
+		size += len(a.Content)
+	}
+	return size
+}
+
+// applyFrom sends msg from its own From when it has a valid one. An invalid
+// one fails the message, or is replaced by the From of the rule with
+// Features.FallbackFrom.
+func (s *Service) applyFrom(msg *Message) error {
+	if msg.From == "" {
+		return nil
+	}
+
+	if _, err := netmail.ParseAddress(msg.From); err != nil {
+		if !s.features.FallbackFrom {
+			return fmt.Errorf("invalid from address %q: %w", msg.From, err)
+		}
+		s.zlog.Warn("invalid from address, falling back to the rule one",
+			zap.String("txnno", msg.TxnNo),
+			zap.String("from", msg.From),
+			zap.String("fallback", msg.rule.From),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	msg.rule.From = msg.From
+	return nil
+}
+
+// applyReplyTo directs the replies to msg to its own ReplyTo when it has a
+// valid one. An invalid one is left out, the replies go where they would
+// without it.
+func (s *Service) applyReplyTo(msg *Message) {
+	if msg.ReplyTo == "" {
+		return
+	}
+
+	if _, err := netmail.ParseAddress(msg.ReplyTo); err != nil {
+		s.zlog.Warn("invalid reply-to address, ignored",
+			zap.String("txnno", msg.TxnNo),
+			zap.String("reply_to", msg.ReplyTo),
+			zap.Error(err),
+		)
+		return
+	}
+
+	msg.rule.ReplyTo = msg.ReplyTo
+}
+
+// checkRecipientDomains drops the recipients whose domain cannot receive
+// mail, failing when no recipient is left to send to.
+func (s *Service) checkRecipientDomains(ctx context.Context, msg *Message) error {
+	to, droppedTo := s.mx.filter(ctx, msg.ToAddresses)
+	bcc, droppedBCC := s.mx.filter(ctx, msg.BCCAddresses)
+
+	if dropped := append(droppedTo, droppedBCC...); len(dropped) > 0 {
+		s.zlog.Warn("dropping recipients without mail server",
+			zap.String("txnno", msg.TxnNo),
+			zap.Strings("recipients", dropped),
+		)
+	}
+	msg.ToAddresses = to
+	msg.BCCAddresses = bcc
+	if !s.hasRecipients(msg) {
+		return fmt.Errorf("no recipient domain can receive mail: %s", strings.Join(append(droppedTo, droppedBCC...), ", "))
+	}
+	return nil
+}
+
+// buildMailMessage builds the mail for msg with gopkg.in/mail.v2.
+func (s *Service) buildMailMessage(msg *Message) (*mail.Message, error) {
+	c := newMailComposer()
+	if err := s.compose(c, msg); err != nil {
+		return nil, err
+	}
+	return c.m, nil
+}
+
+// compose writes the headers, body and attachments of msg to c.
+func (s *Service) compose(c composer, msg *Message) error {
+	c.SetAddressHeader("From", msg.rule.From)
+	if len(msg.ToAddresses) > 0 {
+		c.SetAddressHeader("To", msg.ToAddresses...)
+	} else {
+		// A BCC-only message, the relay gets the recipients from the
+		// envelope.
+		c.SetHeader("To", undisclosedRecipients)
+	}
+	if len(msg.CCAddresses) > 0 {
+		c.SetAddressHeader("Cc", msg.CCAddresses...)
+	}
+	if len(msg.BCCAddresses) > 0 {
+		// The Bcc header only feeds the envelope, it is not written out.
+		c.SetAddressHeader("Bcc", msg.BCCAddresses...)
+	}
+	if msg.rule.ReplyTo != "" {
+		c.SetAddressHeader("Reply-To", msg.rule.ReplyTo)
+	}
+	c.SetHeader("Subject", msg.rule.SubjectPrefix+msg.Subject)
+	if msg.rule.ListUnsubscribe != "" {
+		c.SetHeader("List-Unsubscribe", msg.rule.ListUnsubscribe)
+	}
+	if msg.rule.Importance != "" {
+		c.SetHeader("Importance", msg.rule.Importance)
+		c.SetHeader("X-Priority", xPriority[msg.rule.Importance])
+	}
+	setTraceHeaders(c, msg.trace)
+
+	receiptAddress := s.receiptAddress
+	if receiptAddress == "" {
+		receiptAddress = msg.rule.From
+	}
+	if msg.RequestReadReceipt {
+		c.SetAddressHeader("Disposition-Notification-To", receiptAddress)
+	}
+	if msg.RequestDeliveryReceipt {
+		c.SetAddressHeader("Return-Receipt-To", receiptAddress)
+	}
+
+	body, err := s.renderBody(msg)
+	if err != nil {
+		return err
+	}
+	text, err := s.renderText(msg)
+	if err != nil {
+		return err
+	}
+	// multipart/alternative lists the preferred part last.
+	c.SetBody("text/plain", text)
+	c.AddAlternative("text/html", body)
+
+	for _, a := range msg.Attachments {
+		a.ContentType = a.contentType(s.features.DetectAttachmentTypes)
+		c.Attach(a)
+	}
+
+	return nil
+}
+
+// renderBody wraps the content of msg, followed by the footer, in the HTML
+// body wrapper. Plain-text content is HTML-escaped first so characters like < and
+// & show up as written. Content larger than maxContentBytes is rejected
+// instead of being copied around.
+func (s *Service) renderBody(msg *Message) (string, error) {
+	if s.maxContentBytes > 0 && len(msg.Content) > s.maxContentBytes {
+		return "", fmt.Errorf("content is %d bytes, over the %d bytes limit", len(msg.Content), s.maxContentBytes)
+	}
+
+	content := msg.Content
+	if msg.EscapeContent() {
+		content = html.EscapeString(content)
+	}
+
+	footer, err := msg.rule.footer.renderHTML(msg)
+	if err != nil {
+		return "", err
+	}
+
+	return s.wrapper.render(msg, content+footer)
+}
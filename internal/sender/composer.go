@@ -0,0 +1,103 @@
+package sender
+
+import (
+	"io"
+	"mime"
+	netmail "net/mail"
+
+	"gopkg.in/mail.v2"
+)
+
+// composer is the mail library seen by compose. It is kept to what the
+// sender needs so the library behind it can be swapped, e.g. for
+// github.com/wneessen/go-mail, by writing another implementation.
+type composer interface {
+	SetHeader(field string, values ...string)
+	// SetAddressHeader sets field to addresses, each a bare address or a
+	// "Name <address>" one whose name is encoded per RFC 2047 when it is
+	// not ASCII.
+	SetAddressHeader(field string, addresses ...string)
+	SetBody(contentType, body string)
+	AddAlternative(contentType, body string)
+	Attach(a Attachment)
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// mailComposer is the gopkg.in/mail.v2 composer.
+type mailComposer struct {
+	m *mail.Message
+}
+
+var _ composer = (*mailComposer)(nil)
+
+func newMailComposer() *mailComposer {
+	return &mailComposer{m: mail.NewMessage()}
+}
+
+func (c *mailComposer) SetHeader(field string, values ...string) {
+	c.m.SetHeader(field, values...)
+}
+
+// SetAddressHeader formats each address on its own: SetHeader would encode
+// the whole value, address included, which clients cannot read back.
+// Values that do not parse, like "undisclosed-recipients:;", are set as
+// they are.
+func (c *mailComposer) SetAddressHeader(field string, addresses ...string) {
+	values := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		addr, err := netmail.ParseAddress(a)
+		if err != nil {
+			values = append(values, a)
+			continue
+		}
+		values = append(values, c.m.FormatAddress(addr.Address, addr.Name))
+	}
+	c.m.SetHeader(field, values...)
+}
+
+func (c *mailComposer) SetBody(contentType, body string) {
+	c.m.SetBody(contentType, body)
+}
+
+func (c *mailComposer) AddAlternative(contentType, body string) {
+	c.m.AddAlternative(contentType, body)
+}
+
+// Attach adds a to the mail. A reader given to AttachReader can only be
+// consumed once, so the content goes through a copy function instead to let
+// the mail be written more than once, e.g. when a send is retried.
+func (c *mailComposer) Attach(a Attachment) {
+	settings := []mail.FileSetting{
+		mail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(a.Content)
+			return err
+		}),
+	}
+	if contentType, ok := attachmentContentType(a); ok {
+		settings = append(settings, mail.SetHeader(map[string][]string{
+			"Content-Type": {contentType},
+		}))
+	}
+
+	c.m.AttachReader(a.Name, nil, settings...)
+}
+
+// attachmentContentType returns the content type of a with its name added
+// to the parameters it already has, e.g. a charset. It returns false when
+// a has no content type, or one that does not parse, the library then
+// picks it from the name.
+func attachmentContentType(a Attachment) (string, bool) {
+	if a.ContentType == "" {
+		return "", false
+	}
+	mediaType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		return "", false
+	}
+	params["name"] = a.Name
+	return mime.FormatMediaType(mediaType, params), true
+}
+
+func (c *mailComposer) WriteTo(w io.Writer) (int64, error) {
+	return c.m.WriteTo(w)
+}
@@ -0,0 +1,27 @@
+package sender
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAttachKeepsContentTypeParameters(t *testing.T) {
+	c := newMailComposer()
+	c.SetHeader("From", "noreply@example.com")
+	c.SetBody(ContentTypePlain, "report attached")
+	c.Attach(Attachment{
+		Name:        "report.csv",
+		ContentType: "text/csv; charset=utf-8",
+		Content:     []byte("a,b\n"),
+	})
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "Content-Type: text/csv; charset=utf-8; name=report.csv"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("mail = %s, want the header %q", buf.String(), want)
+	}
+}
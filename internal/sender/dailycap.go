@@ -0,0 +1,152 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// Actions on a message to a recipient who reached the daily cap.
+const (
+	// DailyCapDefer moves the message to the queue of the next day.
+	DailyCapDefer = "defer"
+	// DailyCapDrop takes the message out of the queue as failed.
+	DailyCapDrop = "drop"
+)
+
+// RecipientCounter counts the messages sent to each address per day, for
+// the daily cap. The counts outlive the process.
+type RecipientCounter interface {
+	// Counts returns how many messages each of addrs got on day, the
+	// addresses without any are left out.
+	Counts(ctx context.Context, day string, addrs []string) (map[string]int, error)
+	// Add counts a message sent to each of addrs on day.
+	Add(ctx context.Context, day string, addrs []string) error
+}
+
+// sqlRecipientCounter keeps the counts, per lowercased address and date, in
+// dbo.tb_emailRecipientDaily.
+type sqlRecipientCounter struct {
+	db *sqlStore
+}
+
+func (c *sqlRecipientCounter) Counts(ctx context.Context, day string, addrs []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(addrs) == 0 {
+		return counts, nil
+	}
+
+	q, args := c.db.sb.Select("emailaddress", "sentcount").
+		From("dbo.tb_emailRecipientDaily").
+		Where(sq.Eq{
+			"emailaddress": lowerAll(addrs),
+			"sentdate":     day,
+		}).
+		MustSql()
+
+	rows, err := c.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tb_emailRecipientDaily: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr string
+		var n int
+		if err := rows.Scan(&addr, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan tb_emailRecipientDaily: %w", err)
+		}
+		counts[strings.ToLower(addr)] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate tb_emailRecipientDaily: %w", err)
+	}
+	return counts, nil
+}
+
+func (c *sqlRecipientCounter) Add(ctx context.Context, day string, addrs []string) error {
+	for _, addr := range lowerAll(addrs) {
+		q, args := c.db.sb.Update("dbo.tb_emailRecipientDaily").
+			Set("sentcount", sq.Expr("sentcount + 1")).
+			Where(sq.Eq{"emailaddress": addr, "sentdate": day}).
+			MustSql()
+
+		res, err := c.db.ExecContext(ctx, q, args...)
+		if err != nil {
+			return fmt.Errorf("failed to update tb_emailRecipientDaily: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			continue
+		}
+
+		q, args = c.db.sb.Insert("dbo.tb_emailRecipientDaily").
+			Columns("emailaddress", "sentdate", "sentcount").
+			Values(addr, day, 1).
+			MustSql()
+
+		if _, err := c.db.ExecContext(ctx, q, args...); err != nil {
+			return fmt.Errorf("failed to insert tb_emailRecipientDaily: %w", err)
+		}
+	}
+	return nil
+}
+
+func lowerAll(addrs []string) []string {
+	lower := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		lower = append(lower, strings.ToLower(addr))
+	}
+	return lower
+}
+
+// SetRecipientCounter replaces the counts of the daily cap.
+func (s *Service) SetRecipientCounter(c RecipientCounter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recipientCounter = c
+}
+
+// capDay returns the day t counts against, the local date the queue is
+// dated with.
+func capDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// overDailyCap returns a recipient of msg who already got dailyCap
+// messages on day, counting the ones picked earlier in the run, in
+// pending. The recipients of a message under the cap are added to pending.
+// The cap is a policy, not a safeguard: when the counts cannot be read the
+// message goes out.
+func (s *Service) overDailyCap(ctx context.Context, zlog *zap.Logger, msg *Message, day string, pending map[string]int) (string, bool) {
+	rcpts := lowerAll(recipientsOf(msg))
+	counts, err := s.recipientCounter.Counts(ctx, day, rcpts)
+	if err != nil {
+		zlog.Error("failed to read the daily recipient counts", zap.String("txnno", msg.TxnNo), zap.Error(err))
+		return "", false
+	}
+
+	for _, addr := range rcpts {
+		if counts[addr]+pending[addr] >= s.dailyCap {
+			return addr, true
+		}
+	}
+	for _, addr := range rcpts {
+		pending[addr]++
+	}
+	return "", false
+}
+
+// countSent adds the messages sent on day to the daily counts of their
+// recipients.
+func (s *Service) countSent(ctx context.Context, zlog *zap.Logger, day string, sent []*Message) {
+	for _, msg := range sent {
+		if err := s.recipientCounter.Add(ctx, day, lowerAll(recipientsOf(msg))); err != nil {
+			zlog.Error("failed to count the daily recipients", zap.String("txnno", msg.TxnNo), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package sender
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// dedupCache remembers what was sent to whom for ttl, across runs, so a
+// notification queued twice upstream is not delivered twice.
+type dedupCache struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	sent map[dedupKey]time.Time
+}
+
+// dedupKey is a recipient and the hash of the content sent to it.
+type dedupKey struct {
+	recipient string
+	hash      string
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		ttl:  ttl,
+		sent: make(map[dedupKey]time.Time),
+	}
+}
+
+// duplicate reports whether every recipient of msg got the same subject
+// and content less than ttl ago.
+func (c *dedupCache) duplicate(msg *Message, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rcpts := recipientsOf(msg)
+	if len(rcpts) == 0 {
+		return false
+	}
+
+	hash := contentHash(msg)
+	for _, rcpt := range rcpts {
+		at, ok := c.sent[dedupKey{recipient: strings.ToLower(rcpt), hash: hash}]
+		if !ok || now.Sub(at) >= c.ttl {
+			return false
+		}
+	}
+	return true
+}
+
+// add records msgs as sent at now and forgets the expired entries.
+func (c *dedupCache) add(msgs []*Message, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, at := range c.sent {
+		if now.Sub(at) >= c.ttl {
+			delete(c.sent, key)
+		}
+	}
+
+	for _, msg := range msgs {
+		hash := contentHash(msg)
+		for _, rcpt := range recipientsOf(msg) {
+			c.sent[dedupKey{recipient: strings.ToLower(rcpt), hash: hash}] = now
+		}
+	}
+}
+
+func contentHash(msg *Message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s", msg.Subject, msg.Content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (db *sqlStore) MarkDuplicate(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusDuplicate).
+		Set("comments", msg.Comment).
+		Where(sq.Eq{"TWID": msg.ID}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to mark message as duplicate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"slices"
+	"strings"
+)
+
+// authResolver is the subset of *net.Resolver used to check the SPF and
+// DMARC records of the sender domains.
+type authResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Results of an SPF check, as named by RFC 7208.
+const (
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFNeutral   = "neutral"
+	SPFNone      = "none"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+	// SPFPresent is a domain with an SPF record checked without a sending
+	// IP to evaluate it for.
+	SPFPresent = "present"
+)
+
+var spfQualifiers = map[byte]string{
+	'+': SPFPass,
+	'-': SPFFail,
+	'~': SPFSoftFail,
+	'?': SPFNeutral,
+}
+
+// maxSPFLookups is the limit of DNS lookups of an SPF evaluation, set by
+// RFC 7208.
+const maxSPFLookups = 10
+
+// errSPFUnsupported is a mechanism the check does not evaluate.
+var errSPFUnsupported = errors.New("unsupported spf mechanism")
+
+// SenderAuthReport is the SPF and DMARC alignment of a From domain.
+type SenderAuthReport struct {
+	Domain string `json:"domain"`
+	// SPF is one of the SPF result constants for the sending IP.
+	SPF   string `json:"spf"`
+	DMARC bool   `json:"dmarc"`
+	// Warnings tell what would hurt the deliverability of the domain.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CheckSenderAuth checks that the From domains of the messages publish an
+// SPF record permitting the sending IP, and a DMARC record. It is advisory:
+// the findings are returned, nothing is blocked.
+func (s *Service) CheckSenderAuth(ctx context.Context) []SenderAuthReport {
+	ctx, cancel := context.WithTimeout(ctx, s.authTimeout)
+	defer cancel()
+
+	reports := make([]SenderAuthReport, 0)
+	for _, domain := range s.senderDomains() {
+		r := SenderAuthReport{Domain: domain}
+
+		if s.sendingIP == nil {
+			r.SPF = SPFNone
+			if rec, err := spfRecord(ctx, s.authResolver, domain); err != nil {
+				r.SPF = SPFTempError
+			} else if rec != "" {
+				r.SPF = SPFPresent
+			}
+		} else {
+			c := &spfCheck{resolver: s.authResolver, ip: s.sendingIP}
+			var err error
+			r.SPF, err = c.check(ctx, domain)
+			if err != nil {
+				r.Warnings = append(r.Warnings, fmt.Sprintf("SPF check failed: %s", err))
+			}
+		}
+		switch r.SPF {
+		case SPFNone:
+			r.Warnings = append(r.Warnings, "no SPF record")
+		case SPFFail, SPFSoftFail:
+			r.Warnings = append(r.Warnings, fmt.Sprintf("SPF does not permit %s", s.sendingIP))
+		case SPFNeutral:
+			r.Warnings = append(r.Warnings, fmt.Sprintf("SPF neither permits nor denies %s", s.sendingIP))
+		}
+
+		dmarc, err := hasDMARC(ctx, s.authResolver, domain)
+		if err != nil {
+			r.Warnings = append(r.Warnings, fmt.Sprintf("DMARC lookup failed: %s", err))
+		} else if !dmarc {
+			r.Warnings = append(r.Warnings, "no DMARC record")
+		}
+		r.DMARC = dmarc
+
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// senderDomains returns the domains of the From of the default and of
+// every rule, sorted.
+func (s *Service) senderDomains() []string {
+	froms := []string{s.rules.Load().defaults.From}
+	for _, id := range s.rules.Load().ids() {
+		froms = append(froms, s.rules.Load().resolve(id).From)
+	}
+
+	domains := make([]string, 0, len(froms))
+	for _, from := range froms {
+		addr, err := netmail.ParseAddress(from)
+		if err != nil {
+			continue
+		}
+		_, domain, _ := strings.Cut(addr.Address, "@")
+		domain = strings.ToLower(domain)
+		if domain != "" && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	slices.Sort(domains)
+	return domains
+}
+
+// spfRecord returns the SPF record of domain, "" when it has none.
+func spfRecord(ctx context.Context, r authResolver, domain string) (string, error) {
+	txts, err := r.LookupTXT(ctx, domain)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			return txt, nil
+		}
+	}
+	return "", nil
+}
+
+// hasDMARC reports whether domain, or its parent for a subdomain, publishes
+// a DMARC record.
+func hasDMARC(ctx context.Context, r authResolver, domain string) (bool, error) {
+	for {
+		txts, err := r.LookupTXT(ctx, "_dmarc."+domain)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		for _, txt := range txts {
+			if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(txt)), "V=DMARC1") {
+				return true, nil
+			}
+		}
+
+		// The organizational domain covers its subdomains.
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return false, nil
+		}
+		domain = parent
+	}
+}
+
+// spfCheck evaluates SPF records for ip. It supports the all, ip4, ip6, a,
+// mx and include mechanisms and the redirect modifier, the others yield a
+// permerror.
+type spfCheck struct {
+	resolver authResolver
+	ip       net.IP
+	lookups  int
+}
+
+// check returns the SPF result of domain.
+func (c *spfCheck) check(ctx context.Context, domain string) (string, error) {
+	rec, err := spfRecord(ctx, c.resolver, domain)
+	if err != nil {
+		return SPFTempError, err
+	}
+	if rec == "" {
+		return SPFNone, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(rec)[1:] {
+		if k, v, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(k, ":/") {
+			if strings.EqualFold(k, "redirect") {
+				redirect = v
+			}
+			continue
+		}
+
+		result := SPFPass
+		if q, ok := spfQualifiers[term[0]]; ok {
+			result = q
+			term = term[1:]
+		}
+		matched, err := c.match(ctx, domain, term)
+		if err != nil {
+			return SPFPermError, fmt.Errorf("%s: %w", domain, err)
+		}
+		if matched {
+			return result, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := c.lookup(); err != nil {
+			return SPFPermError, err
+		}
+		result, err := c.check(ctx, redirect)
+		if result == SPFNone {
+			return SPFPermError, fmt.Errorf("redirect to %s without SPF record", redirect)
+		}
+		return result, err
+	}
+	return SPFNeutral, nil
+}
+
+// match reports whether the mechanism term of the record of domain matches
+// the ip.
+func (c *spfCheck) match(ctx context.Context, domain, term string) (bool, error) {
+	name, arg, hasArg := strings.Cut(term, ":")
+	var cidr string
+	if hasArg {
+		arg, cidr, _ = strings.Cut(arg, "/")
+	} else {
+		name, cidr, _ = strings.Cut(name, "/")
+	}
+	target := domain
+	if arg != "" {
+		target = arg
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+
+	case "ip4", "ip6":
+		if cidr == "" {
+			return net.ParseIP(arg).Equal(c.ip), nil
+		}
+		_, n, err := net.ParseCIDR(arg + "/" + cidr)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s %q", name, term)
+		}
+		return n.Contains(c.ip), nil
+
+	case "a":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+		return c.hostMatches(ctx, target, cidr)
+
+	case "mx":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		for _, mx := range mxs {
+			ok, err := c.hostMatches(ctx, strings.TrimSuffix(mx.Host, "."), cidr)
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case "include":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+		result, err := c.check(ctx, target)
+		if result == SPFNone {
+			return false, fmt.Errorf("include of %s without SPF record", target)
+		}
+		return result == SPFPass, err
+
+	default:
+		return false, fmt.Errorf("%w %q", errSPFUnsupported, term)
+	}
+}
+
+// hostMatches reports whether an address of host, widened to the cidr
+// prefix length when given, holds the ip.
+func (c *spfCheck) hostMatches(ctx context.Context, host, cidr string) (bool, error) {
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	for _, a := range addrs {
+		if cidr == "" {
+			if a.IP.Equal(c.ip) {
+				return true, nil
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(a.IP.String() + "/" + cidr)
+		if err != nil {
+			return false, fmt.Errorf("invalid cidr length %q", cidr)
+		}
+		if n.Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookup counts a DNS lookup against maxSPFLookups.
+func (c *spfCheck) lookup() error {
+	c.lookups++
+	if c.lookups > maxSPFLookups {
+		return fmt.Errorf("more than %d dns lookups", maxSPFLookups)
+	}
+	return nil
+}
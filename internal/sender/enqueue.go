@@ -0,0 +1,92 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EnqueueRequest is a message queued by hand, e.g. to check the whole
+// queue to relay flow end to end.
+type EnqueueRequest struct {
+	To      []string
+	Subject string
+	Body    string
+	// RuleID picks the settings of the message, the defaults when empty.
+	RuleID string
+}
+
+// Enqueue queues the message of req as StatusAdd for today, for the next
+// send run to pick, and returns its txnno.
+func (s *Service) Enqueue(ctx context.Context, req EnqueueRequest) (string, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "Enqueue"),
+	)
+
+	to := make([]string, 0, len(req.To))
+	for _, addr := range req.To {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, err := netmail.ParseAddress(addr); err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "Invalid recipient %q.", addr)
+		}
+		to = append(to, addr)
+	}
+	if len(to) == 0 {
+		return "", status.Error(codes.InvalidArgument, "At least one recipient is required.")
+	}
+	if strings.TrimSpace(req.Subject) == "" {
+		return "", status.Error(codes.InvalidArgument, "Subject is required.")
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		return "", status.Error(codes.InvalidArgument, "Body is required.")
+	}
+
+	now := time.Now()
+	msg := &Message{
+		TxnNo:       fmt.Sprintf("TEST%d", now.UnixNano()),
+		RuleID:      strings.TrimSpace(req.RuleID),
+		Time:        now.Format("2006-01-02"),
+		Subject:     req.Subject,
+		Content:     req.Body,
+		Status:      StatusAdd,
+		ToAddresses: to,
+	}
+	if err := s.store.Enqueue(ctx, msg); err != nil {
+		zlog.Error("failed to enqueue message", zap.Error(err))
+		return "", err
+	}
+
+	zlog.Info("message enqueued", zap.String("txnno", msg.TxnNo), zap.Strings("to", to))
+	return msg.TxnNo, nil
+}
+
+// Enqueue inserts msg into tb_getEmailWiseSend.
+func (db *sqlStore) Enqueue(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Insert("dbo.tb_getEmailWiseSend").
+		Columns("Txnno", "Ruleid", "txtdate", "toaddress", "subjects", "contents", "rectype").
+		Values(
+			msg.TxnNo,
+			msg.RuleID,
+			msg.Time,
+			strings.Join(msg.ToAddresses, ";"),
+			msg.Subject,
+			msg.Content,
+			msg.Status,
+		).
+		MustSql()
+
+	if _, err := db.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("failed to insert into tb_getEmailWiseSend: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package sender
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnv returns the value of the environment variable key, or fallback
+// when it is unset.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt returns the integer value of the environment variable key, or
+// fallback when it is unset or not a valid integer.
+func getEnvInt(key string, fallback int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// getEnvDuration returns the duration value (e.g. "30s") of the environment
+// variable key, or fallback when it is unset or malformed.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// getEnvFloat returns the float value of the environment variable key, or
+// fallback when it is unset or not a valid number.
+func getEnvFloat(key string, fallback float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// getEnvBool returns the boolean value of the environment variable key, or
+// fallback when it is unset or not a valid boolean.
+func getEnvBool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Types of the timeline events of a message.
+const (
+	// EventQueued is a sent message put back in the queue, after a soft
+	// bounce.
+	EventQueued      = "queued"
+	EventSending     = "sending"
+	EventSent        = "sent"
+	EventRetried     = "retried"
+	EventFailed      = "failed"
+	EventFlagged     = "flagged"
+	EventQuarantined = "quarantined"
+	EventDuplicate   = "duplicate"
+)
+
+// Event is a state transition of a message, stored in dbo.email_events.
+type Event struct {
+	TxnNo  string    `json:"txn_no"`
+	Type   string    `json:"type"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func newEvent(msg *Message, typ, detail string) Event {
+	return Event{TxnNo: msg.TxnNo, Type: typ, Detail: detail, At: time.Now()}
+}
+
+// eventsOf returns an event of typ for each of msgs.
+func eventsOf(msgs []*Message, typ string) []Event {
+	events := make([]Event, 0, len(msgs))
+	for _, msg := range msgs {
+		events = append(events, newEvent(msg, typ, ""))
+	}
+	return events
+}
+
+// recordEvents stores events. The timeline is for auditing only, so a
+// failure is logged and does not stop the send.
+func (s *Service) recordEvents(ctx context.Context, zlog *zap.Logger, events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	if err := s.store.RecordEvents(ctx, events); err != nil {
+		zlog.Error("failed to record message events", zap.Int("count", len(events)), zap.Error(err))
+	}
+}
+
+// MessageEvents returns the timeline of the message with txnNo, oldest
+// first.
+func (s *Service) MessageEvents(ctx context.Context, txnNo string) ([]Event, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "MessageEvents"),
+		zap.String("txnno", txnNo),
+	)
+
+	msg, err := s.store.Get(ctx, txnNo)
+	if err != nil {
+		zlog.Error("failed to get mail message", zap.Error(err))
+		return nil, err
+	}
+	if msg == nil {
+		return nil, status.Errorf(codes.NotFound, "Message %q not found.", txnNo)
+	}
+
+	events, err := s.store.Events(ctx, txnNo)
+	if err != nil {
+		zlog.Error("failed to list message events", zap.Error(err))
+		return nil, err
+	}
+	return events, nil
+}
+
+// RecordEvents inserts events by writeChunk, each one takes 4 parameters.
+func (db *sqlStore) RecordEvents(ctx context.Context, events []Event) error {
+	for chunk := range slices.Chunk(events, writeChunk) {
+		b := db.sb.Insert("dbo.email_events").Columns("txnno", "eventtype", "detail", "createdat")
+		for _, e := range chunk {
+			b = b.Values(e.TxnNo, e.Type, e.Detail, e.At)
+		}
+		q, args := b.MustSql()
+
+		if _, err := db.ExecContext(ctx, q, args...); err != nil {
+			return fmt.Errorf("failed to insert email_events: %w", err)
+		}
+	}
+	return nil
+}
+
+func (db *sqlStore) Events(ctx context.Context, txnNo string) ([]Event, error) {
+	q, args := db.sb.Select("txnno", "eventtype", "detail", "createdat").
+		From("dbo.email_events").
+		Where(sq.Eq{"txnno": txnNo}).
+		OrderBy("createdat ASC", "eventid ASC").
+		MustSql()
+
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query email_events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		var detail sql.NullString
+		if err := rows.Scan(&e.TxnNo, &e.Type, &detail, &e.At); err != nil {
+			return nil, fmt.Errorf("failed to scan email_events: %w", err)
+		}
+		e.Detail = detail.String
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan email_events: %w", err)
+	}
+	return events, nil
+}
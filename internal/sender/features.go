@@ -0,0 +1,157 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Features are the optional behaviors of the sender, loaded once at
+// startup. Each one keeps its own environment variable for compatibility
+// and can be overridden by FEATURES.
+type Features struct {
+	// MXCheck skips the recipients whose domain cannot receive mail.
+	MXCheck bool `json:"mx_check"`
+	// AggressiveAddresses applies the aggressive address normalization.
+	AggressiveAddresses bool `json:"aggressive_addresses"`
+	// BlockMissingUnsubscribe flags the bulk messages without a
+	// List-Unsubscribe header instead of only warning about them.
+	BlockMissingUnsubscribe bool `json:"block_missing_unsubscribe"`
+	// BatchStatusUpdate marks the sent messages with a single statement
+	// instead of calling pd_updategetemailwisesend for each of them.
+	BatchStatusUpdate bool `json:"batch_status_update"`
+	// DetectAttachmentTypes guesses the type of the attachments stored
+	// without one from their name or content.
+	DetectAttachmentTypes bool `json:"detect_attachment_types"`
+	// SplitRecipients sends the messages over MAX_RECIPIENTS in several
+	// envelopes instead of flagging them.
+	SplitRecipients bool `json:"split_recipients"`
+	// BCCOnly sends the messages without To but with BCC recipients,
+	// addressed to undisclosed-recipients.
+	BCCOnly bool `json:"bcc_only"`
+	// Dedup skips the messages whose recipients got the same subject and
+	// content less than DEDUP_TTL ago.
+	Dedup bool `json:"dedup"`
+	// FallbackFrom sends the messages with an invalid From from the From
+	// of their rule instead of flagging them.
+	FallbackFrom bool `json:"fallback_from"`
+	// AuthCheck checks the SPF and DMARC records of the From domains at
+	// startup and warns about the misaligned ones.
+	AuthCheck bool `json:"auth_check"`
+	// Placeholders replaces {{TxnNo}}, {{Date}} and {{RuleID}} in the
+	// subject and content with the fields of the message.
+	Placeholders bool `json:"placeholders"`
+	// TraceHeaders writes the trace context of the span active during the
+	// send to the Traceparent and Tracestate headers.
+	TraceHeaders bool `json:"trace_headers"`
+
+	// The schema features read the columns and tables added by the
+	// migrations of the same name, they have no variable of their own.
+
+	// Attachments reads the attachmenturl column and the
+	// tb_emailAttachment table.
+	Attachments bool `json:"attachments"`
+	// Receipts reads the readreceipt and deliveryreceipt columns.
+	Receipts bool `json:"receipts"`
+	// ContentTypes reads the contenttype column.
+	ContentTypes bool `json:"content_types"`
+	// Amounts reads the amount column.
+	Amounts bool `json:"amounts"`
+	// Locales reads the locale column.
+	Locales bool `json:"locales"`
+	// Priorities reads the priority column and sends the high priority
+	// messages first.
+	Priorities bool `json:"priorities"`
+	// FromOverrides reads the fromaddress and replytoaddress columns.
+	FromOverrides bool `json:"from_overrides"`
+	// Templates reads the templatename and templatedata columns.
+	Templates bool `json:"templates"`
+	// Suppression drops the recipients listed in tb_emailSuppression and
+	// lists the hard bounced ones there.
+	Suppression bool `json:"suppression"`
+}
+
+// LoadFeatures reads the features from the environment. FEATURES is a comma
+// separated list of feature names to turn on, or off when prefixed with
+// "-", e.g. "mx_check,-batch_status_update".
+func LoadFeatures() (Features, error) {
+	f := Features{
+		MXCheck:                 getEnvBool("MX_CHECK_ENABLED", false),
+		AggressiveAddresses:     getEnvBool("ADDRESS_NORMALIZE_AGGRESSIVE", false),
+		BlockMissingUnsubscribe: getEnv("UNSUBSCRIBE_POLICY", "warn") == "block",
+		BatchStatusUpdate:       getEnv("STATUS_UPDATE_MODE", "per-message") == "batch",
+		DetectAttachmentTypes:   getEnvBool("ATTACHMENT_DETECT_CONTENT_TYPE", true),
+		SplitRecipients:         getEnv("RECIPIENT_LIMIT_POLICY", "flag") == "split",
+		BCCOnly:                 getEnvBool("BCC_ONLY_ENABLED", false),
+		Dedup:                   getEnvBool("DEDUP_ENABLED", false),
+		FallbackFrom:            getEnv("FROM_FALLBACK_POLICY", "flag") == "fallback",
+		AuthCheck:               getEnvBool("AUTH_CHECK_ENABLED", false),
+		Placeholders:            getEnvBool("PLACEHOLDERS_ENABLED", false),
+		TraceHeaders:            getEnvBool("TRACE_HEADERS_ENABLED", false),
+	}
+
+	for _, name := range splitList(getEnv("FEATURES", ""), ',') {
+		on := !strings.HasPrefix(name, "-")
+		flag, ok := f.flags()[strings.TrimPrefix(name, "-")]
+		if !ok {
+			return f, fmt.Errorf("unknown feature %q", name)
+		}
+		*flag = on
+	}
+	return f, nil
+}
+
+// flags returns the features of f by name.
+func (f *Features) flags() map[string]*bool {
+	return map[string]*bool{
+		"mx_check":                  &f.MXCheck,
+		"aggressive_addresses":      &f.AggressiveAddresses,
+		"block_missing_unsubscribe": &f.BlockMissingUnsubscribe,
+		"batch_status_update":       &f.BatchStatusUpdate,
+		"detect_attachment_types":   &f.DetectAttachmentTypes,
+		"split_recipients":          &f.SplitRecipients,
+		"bcc_only":                  &f.BCCOnly,
+		"dedup":                     &f.Dedup,
+		"fallback_from":             &f.FallbackFrom,
+		"auth_check":                &f.AuthCheck,
+		"placeholders":              &f.Placeholders,
+		"trace_headers":             &f.TraceHeaders,
+		"attachments":               &f.Attachments,
+		"receipts":                  &f.Receipts,
+		"content_types":             &f.ContentTypes,
+		"amounts":                   &f.Amounts,
+		"locales":                   &f.Locales,
+		"priorities":                &f.Priorities,
+		"from_overrides":            &f.FromOverrides,
+		"templates":                 &f.Templates,
+		"suppression":               &f.Suppression,
+	}
+}
+
+// Fields returns f as log fields.
+func (f Features) Fields() []zap.Field {
+	return []zap.Field{
+		zap.Bool("mx_check", f.MXCheck),
+		zap.Bool("aggressive_addresses", f.AggressiveAddresses),
+		zap.Bool("block_missing_unsubscribe", f.BlockMissingUnsubscribe),
+		zap.Bool("batch_status_update", f.BatchStatusUpdate),
+		zap.Bool("detect_attachment_types", f.DetectAttachmentTypes),
+		zap.Bool("split_recipients", f.SplitRecipients),
+		zap.Bool("bcc_only", f.BCCOnly),
+		zap.Bool("dedup", f.Dedup),
+		zap.Bool("fallback_from", f.FallbackFrom),
+		zap.Bool("auth_check", f.AuthCheck),
+		zap.Bool("placeholders", f.Placeholders),
+		zap.Bool("trace_headers", f.TraceHeaders),
+		zap.Bool("attachments", f.Attachments),
+		zap.Bool("receipts", f.Receipts),
+		zap.Bool("content_types", f.ContentTypes),
+		zap.Bool("amounts", f.Amounts),
+		zap.Bool("locales", f.Locales),
+		zap.Bool("priorities", f.Priorities),
+		zap.Bool("from_overrides", f.FromOverrides),
+		zap.Bool("templates", f.Templates),
+		zap.Bool("suppression", f.Suppression),
+	}
+}
@@ -0,0 +1,105 @@
+package sender
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// footer is the legal disclaimer appended to every mail. Both parts are Go
+// templates executed with a footerData.
+type footer struct {
+	html *template.Template
+	text *template.Template
+}
+
+// footerData is the data available to the footer templates, e.g.
+// "© {{.Year}} Example", "{{.RuleID}}" or "{{formatDate .Date}}". The
+// formatDate function writes a date in the locale of the message.
+type footerData struct {
+	Year   int
+	RuleID string
+	TxnNo  string
+	// Date is the date of the message, Now the time it is rendered.
+	Date string
+	Now  time.Time
+}
+
+// newFooter parses the footer templates, an empty template disables the
+// matching part.
+func newFooter(html, text string) (*footer, error) {
+	f := new(footer)
+
+	if html != "" {
+		t, err := template.New("footer.html").Funcs(templateFuncs(defaultLocale)).Parse(html)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAIL_FOOTER_HTML: %w", err)
+		}
+		f.html = t
+	}
+
+	if text != "" {
+		t, err := template.New("footer.txt").Funcs(templateFuncs(defaultLocale)).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAIL_FOOTER_TEXT: %w", err)
+		}
+		f.text = t
+	}
+
+	return f, nil
+}
+
+func newFooterData(msg *Message) footerData {
+	now := time.Now()
+	return footerData{
+		Year:   now.Year(),
+		RuleID: msg.RuleID,
+		TxnNo:  msg.TxnNo,
+		Date:   msg.Time,
+		Now:    now,
+	}
+}
+
+// renderHTML returns the HTML footer for msg, or "" when there is none.
+func (f *footer) renderHTML(msg *Message) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	return executeLocale(f.html, msg.Locale, newFooterData(msg))
+}
+
+// renderText returns the plain-text footer for msg, or "" when there is
+// none.
+func (f *footer) renderText(msg *Message) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	return executeLocale(f.text, msg.Locale, newFooterData(msg))
+}
+
+// executeLocale executes t with the template functions of locale. The
+// functions are bound on a clone so concurrent renders do not race.
+func executeLocale(t *template.Template, locale string, data any) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+
+	t, err := t.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to clone template: %w", err)
+	}
+	return execute(t.Funcs(templateFuncs(locale)), data)
+}
+
+func execute(t *template.Template, data any) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", t.Name(), err)
+	}
+	return buf.String(), nil
+}
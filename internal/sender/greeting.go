@@ -0,0 +1,119 @@
+package sender
+
+import (
+	"net"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RelayGreeting is what a relay told the sender on its last successful
+// dial, to diagnose why an extension such as STARTTLS or an AUTH mechanism
+// is not used.
+type RelayGreeting struct {
+	// Profile is the SMTP profile of the relay, "" for the default one.
+	Profile string `json:"profile"`
+	// Banner is the text of the 220 greeting, one line per reply line.
+	Banner string `json:"banner"`
+	// Extensions are the ESMTP extensions advertised after the last
+	// EHLO, with their parameters, e.g. "AUTH PLAIN LOGIN".
+	Extensions []string  `json:"extensions"`
+	At         time.Time `json:"at"`
+}
+
+// knownExtensions are the extensions looked for in the EHLO reply:
+// net/smtp only answers for a given name.
+var knownExtensions = []string{
+	"STARTTLS", "AUTH", "SIZE", "PIPELINING", "8BITMIME", "SMTPUTF8", "DSN",
+	"CHUNKING", "BINARYMIME", "ENHANCEDSTATUSCODES", "REQUIRETLS",
+	"DELIVERBY", "ETRN", "VRFY", "HELP",
+}
+
+// advertisedExtensions returns the known extensions c advertised.
+func advertisedExtensions(c *smtp.Client) []string {
+	exts := make([]string, 0, len(knownExtensions))
+	for _, name := range knownExtensions {
+		ok, param := c.Extension(name)
+		if !ok {
+			continue
+		}
+		if param != "" {
+			name += " " + param
+		}
+		exts = append(exts, name)
+	}
+	return exts
+}
+
+// maxBannerBytes caps the greeting recorded, the rest still goes through.
+const maxBannerBytes = 4096
+
+// bannerConn records the greeting the relay sends when the connection
+// opens, up to the last line of its reply.
+type bannerConn struct {
+	net.Conn
+
+	buf  []byte
+	done bool
+}
+
+func (c *bannerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		c.done = len(c.buf) >= maxBannerBytes || lastReplyLine(c.buf)
+	}
+	return n, err
+}
+
+// lastReplyLine reports whether buf ends with the last line of a reply,
+// the one whose code is followed by a space rather than a dash.
+func lastReplyLine(buf []byte) bool {
+	lines := strings.Split(string(buf), "\r\n")
+	for _, line := range lines[:len(lines)-1] {
+		if len(line) >= 4 && line[3] == ' ' || len(line) == 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// banner returns the text of the recorded greeting, without the reply
+// codes.
+func (c *bannerConn) banner() string {
+	lines := strings.Split(strings.TrimRight(string(c.buf), "\r\n"), "\r\n")
+	for i, line := range lines {
+		if len(line) > 4 {
+			lines[i] = line[4:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RelayGreetings returns the greeting of every relay dialed since the
+// start, by profile. A replaced dialer has none.
+func (s *Service) RelayGreetings() []RelayGreeting {
+	greetings := make([]RelayGreeting, 0, len(s.dialers))
+	for profile, d := range s.dialers {
+		p, ok := d.(*dialerPool)
+		if !ok {
+			continue
+		}
+		sd, ok := p.dialer.(*smtpDialer)
+		if !ok {
+			continue
+		}
+		if g := sd.greeting.Load(); g != nil {
+			g := *g
+			g.Profile = profile
+			greetings = append(greetings, g)
+		}
+	}
+	slices.SortFunc(greetings, func(a, b RelayGreeting) int {
+		return strings.Compare(a.Profile, b.Profile)
+	})
+	return greetings
+}
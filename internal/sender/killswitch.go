@@ -0,0 +1,95 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// killSwitchName is the row of the kill switch in its table.
+const killSwitchName = "global_kill_switch"
+
+// KillSwitch stops every send while engaged, out of band of the API, for
+// incidents where it cannot be reached.
+type KillSwitch interface {
+	// Engaged reports whether sending is stopped.
+	Engaged(ctx context.Context) (bool, error)
+}
+
+// sqlKillSwitch reads the global_kill_switch row of a config table: the
+// row whose nameColumn is global_kill_switch, engaged when its valueColumn
+// is 1, true, yes or on. A missing row leaves sending on, a table that
+// cannot be read stops it.
+type sqlKillSwitch struct {
+	db          *sqlStore
+	table       string
+	nameColumn  string
+	valueColumn string
+}
+
+// newSQLKillSwitch returns the kill switch of table, nil when table is
+// empty. The names are written into the statement as is.
+func newSQLKillSwitch(db *sqlStore, table, nameColumn, valueColumn string) (*sqlKillSwitch, error) {
+	if table == "" {
+		return nil, nil
+	}
+	if !procedureName.MatchString(table) {
+		return nil, fmt.Errorf("invalid KILL_SWITCH_TABLE %q", table)
+	}
+	for _, c := range []string{nameColumn, valueColumn} {
+		if !columnName.MatchString(c) {
+			return nil, fmt.Errorf("invalid kill switch column name %q", c)
+		}
+	}
+	return &sqlKillSwitch{db: db, table: table, nameColumn: nameColumn, valueColumn: valueColumn}, nil
+}
+
+func (k *sqlKillSwitch) Engaged(ctx context.Context) (bool, error) {
+	q, args := k.db.sb.Select(k.valueColumn).
+		Options("TOP 1").
+		From(k.table).
+		Where(sq.Eq{k.nameColumn: killSwitchName}).
+		MustSql()
+
+	rows, err := k.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to query %s: %w", k.table, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	var value sql.NullString
+	if err := rows.Scan(&value); err != nil {
+		return false, fmt.Errorf("failed to scan %s: %w", k.table, err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(value.String)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	}
+	return false, nil
+}
+
+// CheckKillSwitch reads the kill switch once, so that a misconfigured one
+// stops the startup rather than every send. It reports whether it is
+// engaged, false without a kill switch.
+func (s *Service) CheckKillSwitch(ctx context.Context) (bool, error) {
+	if s.killSwitch == nil {
+		return false, nil
+	}
+	return s.killSwitch.Engaged(ctx)
+}
+
+// SetKillSwitch replaces the kill switch checked before every send, nil
+// disables it.
+func (s *Service) SetKillSwitch(k KillSwitch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.killSwitch = k
+}
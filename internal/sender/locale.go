@@ -0,0 +1,88 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// dateLocale is how a locale writes a date: "<day> <month> <year>".
+type dateLocale struct {
+	months [12]string
+	// yearOffset is added to the Gregorian year, e.g. 543 for the
+	// Buddhist era.
+	yearOffset int
+}
+
+// dateLocales are the locales formatDate knows, by language code.
+var dateLocales = map[string]dateLocale{
+	"en": {months: [12]string{
+		"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December",
+	}},
+	"lo": {months: [12]string{
+		"ມັງກອນ", "ກຸມພາ", "ມີນາ", "ເມສາ", "ພຶດສະພາ", "ມິຖຸນາ",
+		"ກໍລະກົດ", "ສິງຫາ", "ກັນຍາ", "ຕຸລາ", "ພະຈິກ", "ທັນວາ",
+	}},
+	"th": {months: [12]string{
+		"มกราคม", "กุมภาพันธ์", "มีนาคม", "เมษายน", "พฤษภาคม", "มิถุนายน",
+		"กรกฎาคม", "สิงหาคม", "กันยายน", "ตุลาคม", "พฤศจิกายน", "ธันวาคม",
+	}, yearOffset: 543},
+}
+
+// defaultLocale is used for the messages and settings without a known
+// locale.
+const defaultLocale = "en"
+
+// dateLayouts are the layouts a date given as a string is parsed with.
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// formatDate writes v, a time.Time or a date string, the way locale does,
+// e.g. "2 January 2006" in "en". Locales are matched on their language,
+// "lo-LA" is "lo", unknown ones fall back to defaultLocale.
+func formatDate(locale string, v any) (string, error) {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return "", nil
+		}
+		t = *v
+	case string:
+		var err error
+		if t, err = parseDate(v); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("formatDate: unsupported value %T", v)
+	}
+
+	lang, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	l, ok := dateLocales[lang]
+	if !ok {
+		l = dateLocales[defaultLocale]
+	}
+	return fmt.Sprintf("%d %s %d", t.Day(), l.months[t.Month()-1], t.Year()+l.yearOffset), nil
+}
+
+func parseDate(v string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("formatDate: cannot parse date %q", v)
+}
+
+// templateFuncs are the functions available to the templates of a message
+// in locale.
+func templateFuncs(locale string) template.FuncMap {
+	return template.FuncMap{
+		"formatDate": func(v any) (string, error) {
+			return formatDate(locale, v)
+		},
+	}
+}
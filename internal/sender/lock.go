@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errSendBusy is returned by a send that could not start within
+// SEND_LOCK_TIMEOUT, another one holding the service.
+var errSendBusy = status.Error(codes.Unavailable, "Another send is still running, try again later.")
+
+// timedMutex is a mutex whose Lock can give up. Its zero value is unlocked.
+type timedMutex struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (m *timedMutex) init() {
+	m.once.Do(func() {
+		m.ch = make(chan struct{}, 1)
+	})
+}
+
+func (m *timedMutex) Lock() {
+	m.init()
+	m.ch <- struct{}{}
+}
+
+func (m *timedMutex) Unlock() {
+	m.init()
+	<-m.ch
+}
+
+// LockTimeout locks m, waiting at most timeout, for ever when it is 0, and
+// until ctx is done. It reports whether m was locked.
+func (m *timedMutex) LockTimeout(ctx context.Context, timeout time.Duration) bool {
+	m.init()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	case <-expired:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -3,32 +3,412 @@ package sender
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gopkg.in/mail.v2"
+
+	"sendingemail/internal/config"
 )
 
 type Service struct {
-	mu sync.Mutex
+	// mu is held by a send run from start to end, and by the setters. A
+	// send gives up after waiting lockTimeout for it.
+	mu          timedMutex
+	lockTimeout time.Duration
+
+	store    MessageStore
+	zlog     *zap.Logger
+	resolver RecipientResolver
+
+	suppressions SuppressionList
+
+	// dialers holds the dialer of each SMTP profile, a connection pool
+	// unless replaced, "" is the default relay.
+	dialers map[string]Dialer
+	// rules are the settings of each rule. ReloadRules swaps them whole
+	// while the sends, bounces and checks read them.
+	rules atomic.Pointer[rules]
+	// killSwitch stops every send while engaged, nil disables it.
+	killSwitch KillSwitch
+
+	// ruleConfig is the RULE_CONFIG_FILE at ruleConfigPath rules were
+	// last built from, guarded by mu.
+	ruleConfig     *RuleConfigFile
+	ruleConfigPath string
+
+	// build turns a queued message into a mail ready to be sent.
+	build func(*Message) (*mail.Message, error)
+	// wrapper is the HTML document the content of every mail goes in.
+	wrapper *bodyWrapper
+	// templates are the message templates of MAIL_TEMPLATE_DIR by name.
+	templates map[string]*messageTemplate
+
+	// locale is the locale of the messages without one.
+	locale string
+
+	// batchSize is the number of messages a send run picks at most.
+	batchSize int
+	// sendConcurrency is the number of messages of a batch sent at the
+	// same time.
+	sendConcurrency int
+
+	// maxRecipients caps the recipients of a message, 0 for no limit. The
+	// messages over it are flagged, or split with Features.SplitRecipients.
+	maxRecipients int
+
+	// maxContentBytes caps the size of a message content, 0 disables it.
+	maxContentBytes int
+
+	// maxMessageSize caps the content and attachments of a message taken
+	// together, 0 disables it.
+	maxMessageSize int
+
+	// receiptAddress receives the read and delivery receipts, defaults to
+	// the From address.
+	receiptAddress string
+
+	// procMinInterval is the minimum time between two runs of the
+	// pd_wiseSendEmail procedure, 0 runs it before every listing.
+	procMinInterval time.Duration
+	procMu          sync.Mutex
+	procLastRun     time.Time
+
+	// A pd_wiseSendEmail run failing on a deadlock or timeout is retried
+	// up to procRetryAttempts times in all, waiting procRetryBackoff
+	// doubled after each failure.
+	procRetryAttempts int
+	procRetryBackoff  time.Duration
+
+	// smtpMaxRetries is how many more times a message is sent after a
+	// transient SMTP failure, waiting smtpRetryBackoff before the first
+	// retry and twice as long before each next one.
+	smtpMaxRetries   int
+	smtpRetryBackoff time.Duration
+	// warm keeps a connection to each relay open between the runs.
+	warm warmer
+
+	pause   *autoPause
+	fetcher *attachmentFetcher
+
+	// mx checks the recipient domains before sending, nil disables it.
+	mx *mxChecker
+	// logPerMessage logs the outcome of every message of a run on top of
+	// the run summary.
+	logPerMessage bool
+
+	// dailyCap is the number of messages a recipient gets per day at most,
+	// 0 disables it. The messages over it are deferred or dropped, after
+	// dailyCapAction.
+	dailyCap         int
+	dailyCapAction   string
+	recipientCounter RecipientCounter
+
+	// dedup skips the messages already sent to the same recipients
+	// recently, nil disables it.
+	dedup *dedupCache
+
+	// The SPF records of the From domains are checked for sendingIP, only
+	// their presence without it.
+	authResolver authResolver
+	sendingIP    net.IP
+	authTimeout  time.Duration
+
+	// publisher emits the outcome of the messages to the message bus, a
+	// no-op one without EVENT_BUS_URL.
+	publisher EventPublisher
+
+	// Messages left in StatusSending for longer than stuckAfter, e.g.
+	// after a crash, or refused by the relay for now, are requeued until
+	// they reach maxAttempts.
+	stuckAfter  time.Duration
+	maxAttempts int
+
+	features Features
+
+	addresses addressNormalizer
+}
+
+func NewService(_ context.Context, cfg *config.Config, db *sql.DB, zlog *zap.Logger) (*Service, error) {
+	footer, err := newFooter(os.Getenv("MAIL_FOOTER_HTML"), os.Getenv("MAIL_FOOTER_TEXT"))
+	if err != nil {
+		return nil, err
+	}
+	wrapper, err := newBodyWrapper(os.Getenv("MAIL_BODY_WRAPPER"), os.Getenv("MAIL_BODY_WRAPPER_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	templates, err := loadMessageTemplates(os.Getenv("MAIL_TEMPLATE_DIR"))
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := LoadFeatures()
+	if err != nil {
+		return nil, err
+	}
+
+	st := newSQLStore(newResetRetryDB(db))
+	st.features = features
+	if err := st.setAfterSend(os.Getenv("SP_AFTER_SEND")); err != nil {
+		return nil, err
+	}
+	if err := st.setPredicates(os.Getenv("SEND_SELECT"), os.Getenv("SEND_SELECT_COLUMNS")); err != nil {
+		return nil, err
+	}
+
+	batchSize, clamped, err := sendBatchSize(os.Getenv("SEND_BATCH_SIZE"))
+	if err != nil {
+		return nil, err
+	}
+	if clamped {
+		zlog.Warn("SEND_BATCH_SIZE over the maximum, clamped",
+			zap.String("service", "sender"),
+			zap.Int("batch_size", batchSize),
+		)
+	}
+
+	killSwitch, err := newSQLKillSwitch(st,
+		os.Getenv("KILL_SWITCH_TABLE"),
+		getEnv("KILL_SWITCH_NAME_COLUMN", "name"),
+		getEnv("KILL_SWITCH_VALUE_COLUMN", "value"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	dailyCapAction := getEnv("RECIPIENT_DAILY_CAP_ACTION", DailyCapDefer)
+	if dailyCapAction != DailyCapDefer && dailyCapAction != DailyCapDrop {
+		return nil, fmt.Errorf("invalid RECIPIENT_DAILY_CAP_ACTION %q, want %q or %q", dailyCapAction, DailyCapDefer, DailyCapDrop)
+	}
+
+	var sendingIP net.IP
+	if v := os.Getenv("SENDING_IP"); v != "" {
+		if sendingIP = net.ParseIP(v); sendingIP == nil {
+			return nil, fmt.Errorf("invalid SENDING_IP %q", v)
+		}
+	}
+
+	publisher, err := newEventPublisher(
+		os.Getenv("EVENT_BUS_URL"),
+		getEnv("EVENT_BUS_SUBJECT", "sendingemail.events"),
+		getEnvDuration("EVENT_BUS_TIMEOUT", 5*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleConfigPath := os.Getenv("RULE_CONFIG_FILE")
+	ruleCfg, err := loadRuleConfigFile(ruleConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout := getEnvDuration("SMTP_IDLE_TIMEOUT", 30*time.Second)
+	smtpOpts := smtpOptions{
+		dsnNotify:         os.Getenv("SMTP_REQUEST_DSN"),
+		allowInsecureAuth: getEnvBool("SMTP_ALLOW_INSECURE_AUTH", false),
+	}
+	dialers := map[string]Dialer{
+		"": newDialerPool(
+			"",
+			newSMTPDialer(
+				cfg.SMTP.Host,
+				587,
+				cfg.SMTP.Username,
+				cfg.SMTP.Password,
+				smtpOpts,
+			),
+			getEnvInt("SMTP_MAX_CONNS", 2),
+			idleTimeout,
+		),
+	}
+	profiles := map[string]bool{"": true}
+	for name, p := range ruleCfg.SMTPProfiles {
+		port := p.Port
+		if port == 0 {
+			port = 587
+		}
+		dialers[name] = newDialerPool(
+			name,
+			newSMTPDialer(p.Host, port, p.Username, os.Getenv(p.PasswordEnv), smtpOpts),
+			p.MaxConns,
+			idleTimeout,
+		)
+		profiles[name] = true
+	}
+
+	rules, err := newRules(ruleCfg, rule{
+		From:         cfg.MailFrom,
+		CCThresholds: ruleCfg.CCThresholds,
+		footer:       footer,
+	}, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		store:             st,
+		zlog:              zlog,
+		resolver:          &sqlRecipientResolver{db: st},
+		suppressions:      &sqlSuppressionList{db: st},
+		recipientCounter:  &sqlRecipientCounter{db: st},
+		dailyCap:          getEnvInt("RECIPIENT_DAILY_CAP", 0),
+		dailyCapAction:    dailyCapAction,
+		dialers:           dialers,
+		ruleConfig:        ruleCfg,
+		ruleConfigPath:    ruleConfigPath,
+		wrapper:           wrapper,
+		templates:         templates,
+		maxContentBytes:   getEnvInt("MAIL_MAX_CONTENT_BYTES", 10<<20),
+		locale:            getEnv("MAIL_LOCALE", defaultLocale),
+		maxRecipients:     getEnvInt("MAX_RECIPIENTS", 0),
+		batchSize:         batchSize,
+		sendConcurrency:   max(getEnvInt("SEND_CONCURRENCY", 2), 1),
+		lockTimeout:       getEnvDuration("SEND_LOCK_TIMEOUT", time.Minute),
+		logPerMessage:     getEnv("SEND_LOG_VERBOSITY", "per-message") != "summary",
+		maxMessageSize:    getEnvInt("MAX_MESSAGE_SIZE", 25<<20),
+		receiptAddress:    os.Getenv("RECEIPT_ADDRESS"),
+		stuckAfter:        getEnvDuration("SENDING_STUCK_AFTER", 15*time.Minute),
+		maxAttempts:       getEnvInt("SEND_MAX_ATTEMPTS", 3),
+		procMinInterval:   getEnvDuration("PROC_MIN_INTERVAL", 0),
+		procRetryAttempts: getEnvInt("PROC_RETRY_ATTEMPTS", 3),
+		procRetryBackoff:  getEnvDuration("PROC_RETRY_BACKOFF", 200*time.Millisecond),
+		smtpMaxRetries:    getEnvInt("SMTP_MAX_RETRIES", 2),
+		smtpRetryBackoff:  getEnvDuration("SMTP_RETRY_BACKOFF", time.Second),
+		warm:              warmer{interval: getEnvDuration("SMTP_KEEP_WARM_INTERVAL", 0)},
+		features:          features,
+		authResolver:      net.DefaultResolver,
+		sendingIP:         sendingIP,
+		authTimeout:       getEnvDuration("AUTH_CHECK_TIMEOUT", 10*time.Second),
+		publisher:         publisher,
+		addresses:         addressNormalizer{aggressive: features.AggressiveAddresses},
+		pause: newAutoPause(
+			getEnvFloat("AUTO_PAUSE_ERROR_RATE", 0),
+			getEnvDuration("AUTO_PAUSE_WINDOW", 10*time.Minute),
+			getEnvInt("AUTO_PAUSE_MIN_SAMPLES", 20),
+		),
+		fetcher: newAttachmentFetcher(
+			newAttachmentClient(getEnvDuration("ATTACHMENT_FETCH_TIMEOUT", 30*time.Second)),
+			int64(getEnvInt("ATTACHMENT_MAX_BYTES", 10<<20)),
+		),
+	}
+	s.rules.Store(rules)
+	s.build = s.buildMailMessage
+	if killSwitch != nil {
+		s.killSwitch = killSwitch
+	}
 
-	db   *sql.DB
-	zlog *zap.Logger
+	if features.MXCheck {
+		s.mx = newMXChecker(
+			net.DefaultResolver,
+			getEnvDuration("MX_CHECK_TIMEOUT", 5*time.Second),
+			getEnvDuration("MX_CHECK_TTL", time.Hour),
+		)
+	}
+
+	if features.Dedup {
+		s.dedup = newDedupCache(getEnvDuration("DEDUP_TTL", 10*time.Minute))
+	}
+
+	return s, nil
+}
+
+// Close stops the warm-up and releases the idle SMTP connections and the
+// message bus connection held by the service.
+func (s *Service) Close() error {
+	s.warm.stop()
+
+	var errs []error
+	for _, d := range s.dialers {
+		if c, ok := d.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	if c, ok := s.publisher.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
 }
 
-func NewService(_ context.Context, db *sql.DB, zlog *zap.Logger) (*Service, error) {
+// Features returns the optional behaviors turned on.
+func (s *Service) Features() Features {
+	return s.features
+}
+
+// PauseStatus reports whether sending is auto-paused.
+func (s *Service) PauseStatus() AutoPauseStatus {
+	return s.pause.status()
+}
 
-	return &Service{
-		db:   db,
-		zlog: zlog,
-	}, nil
+// Resume lifts an auto-pause so the next run sends again.
+func (s *Service) Resume() {
+	s.pause.resume()
+	senderPaused.Set(0)
+	s.zlog.Info("sending resumed", zap.String("service", "sender"))
 }
 
+// PoolStats returns a snapshot of the connection pool of the default SMTP
+// relay, zero when its dialer was replaced.
+func (s *Service) PoolStats() PoolStats {
+	if p, ok := s.dialers[""].(*dialerPool); ok {
+		return p.Stats()
+	}
+	return PoolStats{}
+}
+
+// SetDialer replaces the dialer of the SMTP profile, "" for the default
+// relay. The replaced dialer is not closed.
+func (s *Service) SetDialer(profile string, d Dialer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dialers[profile] = d
+}
+
+// SetMessageStore replaces the queue the service sends from, e.g. with an
+// in-memory one in tests.
+func (s *Service) SetMessageStore(ms MessageStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = ms
+}
+
+// SetSuppressionList replaces the list of the recipients never sent to.
+func (s *Service) SetSuppressionList(l SuppressionList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.suppressions = l
+}
+
+// SetRecipientResolver replaces the resolver used to expand group codes
+// in the recipient lists.
+func (s *Service) SetRecipientResolver(r RecipientResolver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resolver = r
+}
+
+// ListMessages returns the queued messages. It only reads the queue, the
+// send runs fill it with pd_wiseSendEmail.
 func (s *Service) ListMessages(ctx context.Context) ([]*Message, error) {
 	zlog := s.zlog.With(
 		zap.String("service", "sender"),
@@ -37,79 +417,907 @@ func (s *Service) ListMessages(ctx context.Context) ([]*Message, error) {
 
 	zlog.Info("starting to list messages")
 
-	messages, err := listMailMessages(ctx, s.db)
+	messages, err := s.store.List(ctx, s.queueFilter(RuleFilter{}))
+	if err != nil {
+		zlog.Error("failed to list mail messages", zap.Error(err))
+		return nil, err
+	}
+	return messages, nil
+}
+
+// NextBatch returns the messages the next send run would send, leaving out
+// the ones waiting for the send window of their rule. It does not run
+// pd_wiseSendEmail nor touch the queue.
+func (s *Service) NextBatch(ctx context.Context) ([]*Message, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "NextBatch"),
+	)
+
+	now := time.Now()
+	filter, ok := s.batchFilter(RuleFilter{}, now)
+	if !ok {
+		return []*Message{}, nil
+	}
+
+	listed, err := s.store.List(ctx, filter)
 	if err != nil {
 		zlog.Error("failed to list mail messages", zap.Error(err))
 		return nil, err
 	}
+
+	rules := s.rules.Load()
+	messages := make([]*Message, 0, len(listed))
+	for _, msg := range listed {
+		if rules.resolve(msg.RuleID).window.contains(now) {
+			messages = append(messages, msg)
+		}
+	}
 	return messages, nil
 }
 
+// WriteEML writes the raw RFC 5322 bytes of the mail built for the message
+// with the given txnNo, exactly as Send would hand it to the relay.
+func (s *Service) WriteEML(ctx context.Context, txnNo string, w io.Writer) error {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "WriteEML"),
+		zap.String("txnno", txnNo),
+	)
+
+	msg, err := s.store.Get(ctx, txnNo)
+	if err != nil {
+		zlog.Error("failed to get mail message", zap.Error(err))
+		return err
+	}
+	if msg == nil {
+		return status.Errorf(codes.NotFound, "Message %q not found.", txnNo)
+	}
+
+	m, err := s.prepare(ctx, msg)
+	if err != nil {
+		zlog.Error("failed to build mail message", zap.Error(err))
+		return status.Errorf(codes.FailedPrecondition, "Message %q cannot be built: %s", txnNo, err)
+	}
+
+	if _, err := m.WriteTo(w); err != nil {
+		zlog.Error("failed to write mail message", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// maxTargetedTxnNos is the number of messages a targeted send can ask for,
+// picked whatever the size of a send batch.
+const maxTargetedTxnNos = 100
+
+// DefaultBatchSize is the number of messages a send run picks without
+// SEND_BATCH_SIZE, maxBatchSize the most it can be set to.
+const (
+	DefaultBatchSize = 100
+	maxBatchSize     = 1000
+)
+
+// sendBatchSize parses SEND_BATCH_SIZE, clamped to maxBatchSize.
+func sendBatchSize(v string) (size int, clamped bool, err error) {
+	if v == "" {
+		return DefaultBatchSize, false, nil
+	}
+
+	size, err = strconv.Atoi(v)
+	if err != nil || size < 1 {
+		return 0, false, fmt.Errorf("invalid SEND_BATCH_SIZE %q, must be a positive integer", v)
+	}
+	if size > maxBatchSize {
+		return maxBatchSize, true, nil
+	}
+	return size, false, nil
+}
+
+// finishTimeout bounds the status updates of a send run cancelled after it
+// handed messages to the relay.
+const finishTimeout = 10 * time.Second
+
+// SendTxnNos sends the queued messages with the given txnNos, whatever
+// their date, to recover them one by one. Every txnNo must exist, the ones
+// not waiting to be sent are reported as OutcomeNotQueued.
+func (s *Service) SendTxnNos(ctx context.Context, txnNos []string) (*SendResult, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "SendTxnNos"),
+		zap.Strings("txnnos", txnNos),
+	)
+
+	if len(txnNos) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "At least one txn_no is required.")
+	}
+	if len(txnNos) > maxTargetedTxnNos {
+		return nil, status.Errorf(codes.InvalidArgument, "At most %d txn_nos can be sent at once.", maxTargetedTxnNos)
+	}
+
+	missing, err := s.store.MissingTxnNos(ctx, txnNos)
+	if err != nil {
+		zlog.Error("failed to look up messages", zap.Error(err))
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, status.Errorf(codes.NotFound, "Messages not found: %s.", strings.Join(missing, ", "))
+	}
+
+	res, err := s.SendRules(ctx, RuleFilter{TxnNos: txnNos})
+
+	picked := make(map[string]bool, len(res.Outcomes))
+	for _, o := range res.Outcomes {
+		picked[o.TxnNo] = true
+	}
+	for _, txnNo := range txnNos {
+		if !picked[txnNo] {
+			res.appendOutcome(MessageOutcome{TxnNo: txnNo, Outcome: OutcomeNotQueued})
+		}
+	}
+	return res, err
+}
+
 // Send will be collect an unsent email from wise and
 // then send all that to registered email address, this method will
 // be use by Cronjob.
-func (s *Service) Send(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Service) Send(ctx context.Context) (*SendResult, error) {
+	return s.SendRules(ctx, RuleFilter{})
+}
 
+// SendRules is like Send but only sends the messages matched by filter.
+func (s *Service) SendRules(ctx context.Context, filter RuleFilter) (*SendResult, error) {
 	zlog := s.zlog.With(
 		zap.String("service", "sender"),
 		zap.String("method", "Send"),
+		zap.String("run_id", RunID(ctx)),
+		zap.Strings("rules", filter.RuleIDs),
 	)
 
-	rawsMessages, err := listMailMessages(ctx, s.db)
+	// A send stuck on a slow relay must not pile the next ones up behind
+	// it.
+	if !s.mu.LockTimeout(ctx, s.lockTimeout) {
+		zlog.Warn("send skipped, another send still running", zap.Duration("waited", s.lockTimeout), zap.Error(ctx.Err()))
+		senderLockTimeouts.Inc()
+		return new(SendResult), errSendBusy
+	}
+	defer s.mu.Unlock()
+
+	res := newSendResult(ctx)
+	defer s.logOutcomes(zlog, res)
+	defer prometheus.NewTimer(senderRunDuration).ObserveDuration()
+
+	if s.killSwitch != nil {
+		engaged, err := s.killSwitch.Engaged(ctx)
+		if err != nil {
+			// It may be engaged, the send must not go on without knowing.
+			zlog.Error("failed to read the kill switch, skipping", zap.Error(err))
+			return res, err
+		}
+		if engaged {
+			zlog.Warn("sending stopped by the kill switch, skipping")
+			return res, nil
+		}
+	}
+
+	if st := s.pause.status(); st.Paused {
+		zlog.Warn("sending is auto-paused, skipping", zap.Time("paused_at", st.PausedAt))
+		return res, nil
+	}
+
+	if err := s.populateQueue(ctx); err != nil {
+		zlog.Error("failed to populate mail messages", zap.Error(err))
+		return res, err
+	}
+
+	now := time.Now()
+	filter, ok := s.batchFilter(filter, now)
+	if !ok {
+		senderHeartbeat.SetToCurrentTime()
+		zlog.Info("every rule is waiting for its send window, skipping")
+		return res, nil
+	}
+
+	rawsMessages, err := s.store.List(ctx, filter)
 	if err != nil {
 		zlog.Error("failed to list mail messages", zap.Error(err))
-		return err
+		return res, err
 	}
+	res.Listed = len(rawsMessages)
+	senderQueueSize.Set(float64(res.Listed))
+
+	// The queue was read, so the loop is alive even when there is nothing
+	// to send.
+	defer senderHeartbeat.SetToCurrentTime()
 
 	if len(rawsMessages) == 0 {
 		zlog.Info("no messages to send")
-		return nil
+		return res, nil
 	}
 
-	messages := make([]*mail.Message, 0, len(rawsMessages))
+	batch := make([]outgoing, 0, len(rawsMessages))
+	events := make([]Event, 0)
+	// postponed are the messages moved to the next day, out of their send
+	// window for the rest of the day or over the daily cap.
+	postponed := make([]*Message, 0)
+	// pending counts the messages of the batch to each recipient, for the
+	// daily cap.
+	day := capDay(now)
+	pending := make(map[string]int)
 	for _, msg := range rawsMessages {
-		if len(msg.ToAddresses) == 0 {
+		if err := ctx.Err(); err != nil {
+			// Nothing was handed to the relay yet, the rest stays queued.
+			zlog.Warn("send cancelled while preparing messages", zap.Error(err))
+			s.recordEvents(context.WithoutCancel(ctx), zlog, events)
+			return res, err
+		}
+
+		if !s.hasRecipients(msg) {
+			res.Skipped++
+			res.addOutcome(msg, OutcomeSkipped, "no recipient")
 			continue
 		}
 
-		m := mail.NewMessage()
-		m.SetHeader("From", os.Getenv("MAIL_FROM"))
-		m.SetHeader("To", msg.ToAddresses...)
-		if len(msg.BCCAddresses) > 0 {
-			m.SetHeader("CC", msg.BCCAddresses...)
+		if w := s.rules.Load().resolve(msg.RuleID).window; !w.contains(now) {
+			reason := "outside of the send window of its rule"
+			if !w.opensLater(now) {
+				// Closed for the rest of the day, the messages of today
+				// would never be listed again.
+				reason += ", moved to the next day"
+				postponed = append(postponed, msg)
+			}
+			res.Deferred++
+			res.addOutcome(msg, OutcomeDeferred, reason)
+			continue
 		}
-		m.SetHeader("Subject", msg.Subject)
-		m.SetBody("text/html", `<html><body style="font-family: Saysettha OT;">`+msg.Content+`</body></html>`)
 
-		messages = append(messages, m)
+		m, err := s.prepare(ctx, msg)
+		if err != nil {
+			var re *runError
+			var pe *panicError
+			var ie *invalidRecipientsError
+			var te *templateError
+			switch {
+			case errors.As(err, &re):
+				// Nothing was handed to the relay yet, the rest stays queued.
+				zlog.Error("failed to prepare messages", zap.String("txnno", msg.TxnNo), zap.Error(err))
+				s.recordEvents(ctx, zlog, events)
+				return res, re.err
+			case errors.As(err, &pe):
+				s.quarantine(ctx, zlog, msg, pe)
+				res.Quarantined++
+				res.addOutcome(msg, OutcomeQuarantined, pe.Error())
+				events = append(events, newEvent(msg, EventQuarantined, pe.Error()))
+				s.countFailure(res, msg)
+			case errors.As(err, &ie):
+				s.skipInvalid(ctx, zlog, msg, ie)
+				res.Skipped++
+				res.addOutcome(msg, OutcomeSkipped, ie.Error())
+				events = append(events, newEvent(msg, EventFailed, ie.Error()))
+			case errors.As(err, &te):
+				s.failTemplate(ctx, zlog, msg, te)
+				res.Failed++
+				res.addOutcome(msg, OutcomeFailed, te.Error())
+				events = append(events, newEvent(msg, EventFailed, te.Error()))
+				s.countFailure(res, msg)
+			default:
+				s.flag(ctx, zlog, msg, err.Error())
+				res.Flagged++
+				res.addOutcome(msg, OutcomeFlagged, err.Error())
+				events = append(events, newEvent(msg, EventFlagged, err.Error()))
+				s.countFailure(res, msg)
+			}
+			continue
+		}
+
+		if s.dedup != nil && s.dedup.duplicate(msg, time.Now()) {
+			s.markDuplicate(ctx, zlog, msg)
+			res.Duplicates++
+			res.addOutcome(msg, OutcomeDuplicate, msg.Comment)
+			events = append(events, newEvent(msg, EventDuplicate, msg.Comment))
+			continue
+		}
+
+		if s.dailyCap > 0 {
+			if addr, over := s.overDailyCap(ctx, zlog, msg, day, pending); over {
+				reason := fmt.Sprintf("%s reached the daily cap of %d messages", addr, s.dailyCap)
+				if s.dailyCapAction == DailyCapDrop {
+					s.dropOverCap(ctx, zlog, msg, reason)
+					res.Skipped++
+					res.addOutcome(msg, OutcomeSkipped, reason)
+					events = append(events, newEvent(msg, EventFailed, reason))
+				} else {
+					postponed = append(postponed, msg)
+					res.Deferred++
+					res.addOutcome(msg, OutcomeDeferred, reason+", moved to the next day")
+				}
+				continue
+			}
+		}
+
+		batch = append(batch, outgoing{msg: msg, mail: m, envelopes: s.envelopes(msg)})
 	}
 
-	dialer := mail.NewDialer(
-		os.Getenv("SMTP_HOST"),
-		587,
-		os.Getenv("SMTP_USERNAME"),
-		os.Getenv("SMTP_PASSWORD"),
-	)
+	s.recordEvents(ctx, zlog, events)
+	s.postpone(ctx, zlog, postponed, now)
 
-	if err := dialer.DialAndSend(messages...); err != nil {
-		zlog.Error("failed to send emails", zap.Error(err))
-		return err
+	if len(batch) == 0 {
+		zlog.Info("no sendable messages")
+		return res, nil
 	}
 
-	for _, msg := range rawsMessages {
-		_, err := s.db.ExecContext(ctx, "EXEC dbo.pd_updategetemailwisesend @txnno", sql.Named("txnno", msg.TxnNo))
+	claimed, err := s.store.MarkSending(ctx, messagesOf(batch))
+	if err != nil {
+		zlog.Error("failed to mark messages as sending", zap.Error(err))
+		return res, err
+	}
+	batch = s.keepClaimed(zlog, batch, claimed, res)
+	if len(batch) == 0 {
+		zlog.Info("no sendable messages left to claim")
+		return res, nil
+	}
+	s.recordEvents(ctx, zlog, eventsOf(messagesOf(batch), EventSending))
+
+	sent, failures, unsent := s.deliver(ctx, zlog, batch, res)
+
+	// The relay accepted the sent messages: their status is updated even
+	// when the run was cancelled, so a later run does not send them again.
+	sendCtx := ctx
+	if ctx.Err() != nil {
+		zlog.Warn("send cancelled, recording the messages sent so far",
+			zap.Int("sent", len(sent)),
+			zap.Int("unsent", len(unsent)),
+		)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), finishTimeout)
+		defer cancel()
+	}
+
+	res.Sent = len(sent)
+	if s.dedup != nil {
+		s.dedup.add(sent, time.Now())
+	}
+	if s.dailyCap > 0 {
+		s.countSent(ctx, zlog, day, sent)
+	}
+	events = eventsOf(sent, EventSent)
+	published := make([]BusEvent, 0, len(sent)+len(failures))
+	for _, msg := range sent {
+		published = append(published, newBusEvent(ctx, msg, EventSent, ""))
+	}
+	requeue := make([]*Message, 0, len(failures)+len(unsent))
+	requeue = append(requeue, unsent...)
+	errs := make([]error, 0, len(failures))
+	failed := 0
+	for _, f := range failures {
+		f.msg.Comment = f.err.Error()
+		errs = append(errs, fmt.Errorf("txnno %s: %w", f.msg.TxnNo, f.err))
+		if isRelayError(f.err) {
+			// The relay failed, not the message: it waits for the relay
+			// to be back.
+			requeue = append(requeue, f.msg)
+			res.Deferred++
+			events = append(events, newEvent(f.msg, EventRetried, f.msg.Comment))
+			published = append(published, newBusEvent(ctx, f.msg, EventRetried, f.msg.Comment))
+			continue
+		}
+
+		if s.retries(f.msg, f.err) {
+			requeue = append(requeue, f.msg)
+			res.Retried++
+			events = append(events, newEvent(f.msg, EventRetried, f.msg.Comment))
+			published = append(published, newBusEvent(ctx, f.msg, EventRetried, f.msg.Comment))
+			continue
+		}
+
+		failed++
+		if isTransientSMTP(f.err) {
+			f.msg.Comment = fmt.Sprintf("%s, given up after %d attempts", f.msg.Comment, f.msg.Attempts)
+		}
+		events = append(events, newEvent(f.msg, EventFailed, f.msg.Comment))
+		published = append(published, newBusEvent(ctx, f.msg, EventFailed, f.msg.Comment))
+		f.msg.Status = StatusFailed
+		if err := s.store.MarkFailed(ctx, f.msg); err != nil {
+			zlog.Error("failed to mark message as failed",
+				zap.String("txnno", f.msg.TxnNo),
+				zap.Error(err),
+			)
+		}
+		s.countFailure(res, f.msg)
+	}
+	res.Failed += failed
+	s.recordEvents(ctx, zlog, events)
+	// Every message the relay refused counts for the auto-pause, the
+	// retried ones too.
+	s.recordOutcomes(zlog, res.Sent, failed+res.Retried)
+	if res.Sent > 0 {
+		senderLastSent.SetToCurrentTime()
+	}
+
+	if len(requeue) > 0 {
+		if err := s.store.Requeue(ctx, requeue); err != nil {
+			zlog.Error("failed to requeue unsent messages", zap.Error(err))
+		}
+	}
+
+	// The consumers of the bus see the messages in their new status.
+	markErr := s.markSent(ctx, zlog, sent)
+	s.publish(ctx, zlog, published...)
+	if markErr != nil {
+		return res, markErr
+	}
+
+	if err := sendCtx.Err(); err != nil {
+		return res, err
+	}
+
+	if len(failures) > 0 {
+		return res, fmt.Errorf("failed to send %d of %d messages: %w", len(failures), len(batch), errors.Join(errs...))
+	}
+
+	zlog.Info("mails sent successfully")
+	return res, nil
+}
+
+// logOutcomes logs what the run did with each message, unless the
+// verbosity is turned down to summary. The messages that did not go out are logged as warnings,
+// with the reason as error.
+func (s *Service) logOutcomes(zlog *zap.Logger, res *SendResult) {
+	if !s.logPerMessage {
+		return
+	}
+
+	for _, o := range res.Outcomes {
+		fields := []zap.Field{
+			zap.String("txnno", o.TxnNo),
+			zap.String("rule_id", o.RuleID),
+			zap.Int("recipients", o.Recipients),
+			zap.String("outcome", o.Outcome),
+		}
+		switch o.Outcome {
+		case OutcomeFailed, OutcomeRetried, OutcomeFlagged, OutcomeQuarantined:
+			zlog.Warn("message processed", append(fields, zap.String("error", o.Reason))...)
+		default:
+			zlog.Info("message processed", append(fields, zap.String("reason", o.Reason))...)
+		}
+	}
+}
+
+// queueFilter returns filter for the messages the service can send, a batch
+// of them. A targeted send picks all of its messages.
+func (s *Service) queueFilter(filter RuleFilter) RuleFilter {
+	filter.IncludeBCCOnly = s.features.BCCOnly
+	filter.Limit = max(s.batchSize, len(filter.TxnNos))
+	return filter
+}
+
+// batchFilter returns filter for the batch of a run at now, as NextBatch
+// and the runs list it. It reports false when every rule is waiting for
+// its send window.
+func (s *Service) batchFilter(filter RuleFilter, now time.Time) (RuleFilter, bool) {
+	filter, ok := s.windowFilter(filter, now)
+	return s.queueFilter(filter), ok
+}
+
+// windowFilter leaves the rules whose send window opens later today out of
+// filter, so that their messages wait in the queue without taking room in
+// the batches. It reports false when no rule is left to list.
+func (s *Service) windowFilter(filter RuleFilter, now time.Time) (RuleFilter, bool) {
+	waiting, defaultWaiting := s.rules.Load().waiting(now)
+	filter.ExcludeRuleIDs = append(slices.Clone(filter.ExcludeRuleIDs), waiting...)
+	if !defaultWaiting {
+		return filter, true
+	}
+
+	// The rules missing from the config wait too, only the configured ones
+	// with an open window are left.
+	open := make([]string, 0)
+	for _, id := range s.rules.Load().ids() {
+		if slices.Contains(filter.ExcludeRuleIDs, id) {
+			continue
+		}
+		if len(filter.RuleIDs) > 0 && !slices.Contains(filter.RuleIDs, id) {
+			continue
+		}
+		open = append(open, id)
+	}
+	filter.RuleIDs = open
+	return filter, len(open) > 0
+}
+
+// postpone moves msgs, which cannot be sent on the day of now, to the queue
+// of the next day.
+func (s *Service) postpone(ctx context.Context, zlog *zap.Logger, msgs []*Message, now time.Time) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	day := now.AddDate(0, 0, 1).Format("2006-01-02")
+	if err := s.store.Postpone(ctx, msgs, day); err != nil {
+		zlog.Error("failed to postpone messages", zap.Int("count", len(msgs)), zap.Error(err))
+		return
+	}
+	zlog.Info("messages postponed", zap.Int("count", len(msgs)), zap.String("day", day))
+}
+
+// hasRecipients reports whether msg has someone to send to: a To
+// recipient, or a BCC one when BCC-only messages are enabled.
+func (s *Service) hasRecipients(msg *Message) bool {
+	return len(msg.ToAddresses) > 0 || s.features.BCCOnly && len(msg.BCCAddresses) > 0
+}
+
+// outgoing is a queued message and the mail built for it.
+type outgoing struct {
+	msg  *Message
+	mail *mail.Message
+	// envelopes are the recipients of each part of a message split for
+	// having too many of them, nil when it is sent whole.
+	envelopes [][]string
+}
+
+func messagesOf(batch []outgoing) []*Message {
+	msgs := make([]*Message, 0, len(batch))
+	for _, o := range batch {
+		msgs = append(msgs, o.msg)
+	}
+	return msgs
+}
+
+// sendFailure is a message the relay did not accept and why.
+type sendFailure struct {
+	msg *Message
+	err error
+}
+
+// keepClaimed returns the messages of batch that were claimed. The others
+// were claimed by another run since they were listed, and are left to it.
+func (s *Service) keepClaimed(zlog *zap.Logger, batch []outgoing, claimed []*Message, res *SendResult) []outgoing {
+	if len(claimed) == len(batch) {
+		return batch
+	}
+
+	ok := make(map[*Message]bool, len(claimed))
+	for _, msg := range claimed {
+		ok[msg] = true
+	}
+	kept := batch[:0]
+	for _, o := range batch {
+		if ok[o.msg] {
+			kept = append(kept, o)
+			continue
+		}
+		zlog.Warn("message claimed by another run, skipping", zap.String("txnno", o.msg.TxnNo))
+		res.Skipped++
+		res.addOutcome(o.msg, OutcomeSkipped, "claimed by another run")
+	}
+	return kept
+}
+
+// deliver hands batch to the relays over up to sendConcurrency workers, so
+// a slow relay does not serialize the batch and a message the relay refuses
+// does not hold back the others, and splits it into the messages the relays
+// accepted and the ones they did not, in batch order. The connection pool
+// of each relay caps the connections the workers share. The outcome of each
+// message is added to res as soon as it is known. Once ctx is done, or a
+// relay could not be used, the messages not started yet are returned
+// unsent.
+func (s *Service) deliver(ctx context.Context, zlog *zap.Logger, batch []outgoing, res *SendResult) (sent []*Message, failed []sendFailure, unsent []*Message) {
+	errs := make([]error, len(batch))
+	started := make([]bool, len(batch))
+
+	// relayDown is closed by the first *RelayError, the next messages would
+	// fail the same way.
+	relayDown := make(chan struct{})
+	var relayErr error
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for range min(s.sendConcurrency, len(batch)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				mu.Lock()
+				if relayErr != nil {
+					mu.Unlock()
+					continue
+				}
+				started[i] = true
+				mu.Unlock()
+
+				o := batch[i]
+				err := s.sendOutgoing(ctx, zlog, o)
+
+				mu.Lock()
+				errs[i] = err
+				switch {
+				case isRelayError(err):
+					zlog.Error("failed to use the relay, stopping the send",
+						zap.String("txnno", o.msg.TxnNo),
+						zap.String("smtp_profile", o.msg.rule.SMTPProfile),
+						zap.Error(err),
+					)
+					res.addOutcome(o.msg, OutcomeDeferred, err.Error())
+					senderSendFailed.Inc()
+					if relayErr == nil {
+						relayErr = err
+						close(relayDown)
+					}
+				case err != nil:
+					zlog.Error("failed to send email",
+						zap.String("txnno", o.msg.TxnNo),
+						zap.String("smtp_profile", o.msg.rule.SMTPProfile),
+						zap.Int("attempts", o.msg.Attempts),
+						zap.Error(err),
+					)
+					outcome := OutcomeFailed
+					if s.retries(o.msg, err) {
+						outcome = OutcomeRetried
+					}
+					res.addOutcome(o.msg, outcome, err.Error())
+					senderSendFailed.Inc()
+				default:
+					res.addOutcome(o.msg, OutcomeSent, "")
+					senderSent.Inc()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case next <- i:
+		case <-relayDown:
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	for i, o := range batch {
+		switch {
+		case !started[i] && relayErr != nil:
+			o.msg.Comment = "not sent, the relay failed: " + relayErr.Error()
+			unsent = append(unsent, o.msg)
+			res.Deferred++
+			res.addOutcome(o.msg, OutcomeDeferred, o.msg.Comment)
+		case !started[i]:
+			o.msg.Comment = "send cancelled before the message was sent"
+			unsent = append(unsent, o.msg)
+			res.Deferred++
+			res.addOutcome(o.msg, OutcomeDeferred, o.msg.Comment)
+		case errs[i] != nil:
+			failed = append(failed, sendFailure{msg: o.msg, err: errs[i]})
+		default:
+			sent = append(sent, o.msg)
+		}
+	}
+	return sent, failed, unsent
+}
+
+// sendOutgoing sends o, part after part when it was split. The message
+// only counts as sent once every part went out.
+func (s *Service) sendOutgoing(ctx context.Context, zlog *zap.Logger, o outgoing) error {
+	d := s.dialers[o.msg.rule.SMTPProfile]
+	if len(o.envelopes) == 0 {
+		return s.sendWithRetry(ctx, zlog, o, func() error {
+			return d.DialAndSend(o.mail)
+		})
+	}
+
+	ed, ok := d.(envelopeDialer)
+	if !ok {
+		return errors.New("the dialer cannot send a message split in several envelopes")
+	}
+	for i, to := range o.envelopes {
+		err := s.sendWithRetry(ctx, zlog, o, func() error {
+			return ed.DialAndSendTo(o.mail, to)
+		})
 		if err != nil {
-			zlog.Error("failed to update get email wise send", zap.Error(err))
+			return fmt.Errorf("failed to send part %d of %d: %w", i+1, len(o.envelopes), err)
+		}
+	}
+	return nil
+}
+
+// sendWithRetry runs send for o, retrying with exponential backoff while the
+// relay fails for a reason that may go away, like a refused connection or a
+// 4xx reply. Permanent failures are returned right away.
+func (s *Service) sendWithRetry(ctx context.Context, zlog *zap.Logger, o outgoing, send func() error) error {
+	p := o.msg.rule.SMTPProfile
+	backoff := s.smtpRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		if attempt > s.smtpMaxRetries || !isTransientSMTP(err) || ctx.Err() != nil {
 			return err
 		}
+
+		zlog.Warn("retrying email",
+			zap.String("txnno", o.msg.TxnNo),
+			zap.String("smtp_profile", p),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to send email: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
+}
 
-	zlog.Info("mails sent successfully")
+// retries reports whether msg, which the relay did not take, goes back to
+// the queue: the send was cancelled, or the failure is transient and msg
+// has attempts left before SEND_MAX_ATTEMPTS.
+func (s *Service) retries(msg *Message, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return isTransientSMTP(err) && msg.Attempts < s.maxAttempts
+}
+
+// recordOutcomes feeds the auto-pause and raises the alert when it trips.
+func (s *Service) recordOutcomes(zlog *zap.Logger, sent, failed int) {
+	tripped, rate := s.pause.record(time.Now(), sent, failed)
+	if !tripped {
+		return
+	}
+
+	senderPaused.Set(1)
+	senderAutoPauses.Inc()
+	zlog.Error("failure rate too high, sending auto-paused until resumed",
+		zap.Float64("failure_rate", rate),
+		zap.Float64("threshold", s.pause.threshold),
+		zap.Duration("window", s.pause.window),
+	)
+}
+
+// countFailure adds a failed, flagged or quarantined msg to res and to the
+// failure metric of its rule.
+func (s *Service) countFailure(res *SendResult, msg *Message) {
+	res.addFailure(msg.RuleID)
+	senderFailures.WithLabelValues(s.rules.Load().label(msg.RuleID)).Inc()
+}
+
+// resolveRecipients expands the group codes in the recipient lists of msg.
+// A failed lookup is returned as a *runError, only the group codes without
+// any member are a problem of msg.
+func (s *Service) resolveRecipients(ctx context.Context, msg *Message) error {
+	to, unresolvedTo, err := s.resolver.Resolve(ctx, msg.ToAddresses)
+	if err != nil {
+		return &runError{err: fmt.Errorf("failed to resolve to addresses: %w", err)}
+	}
+
+	bcc, unresolvedBCC, err := s.resolver.Resolve(ctx, msg.BCCAddresses)
+	if err != nil {
+		return &runError{err: fmt.Errorf("failed to resolve bcc addresses: %w", err)}
+	}
+
+	if unresolved := append(unresolvedTo, unresolvedBCC...); len(unresolved) > 0 {
+		return fmt.Errorf("unresolved recipient group(s): %s", strings.Join(unresolved, ", "))
+	}
+
+	msg.ToAddresses = to
+	msg.BCCAddresses = bcc
 	return nil
 }
 
+// flag takes msg, which cannot be sent as it is, out of the queue as
+// StatusFlagged with the reason in its comments, so the next runs do not
+// pick it again.
+func (s *Service) flag(ctx context.Context, zlog *zap.Logger, msg *Message, reason string) {
+	msg.Status = StatusFlagged
+	msg.Comment = reason
+	zlog.Warn("message flagged",
+		zap.String("txnno", msg.TxnNo),
+		zap.String("reason", reason),
+	)
+
+	if err := s.store.MarkFlagged(ctx, msg); err != nil {
+		zlog.Error("failed to mark message as flagged",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// skipInvalid takes msg out of the queue as failed, its recipients all
+// being invalid, with the reason in its comments.
+func (s *Service) skipInvalid(ctx context.Context, zlog *zap.Logger, msg *Message, ie *invalidRecipientsError) {
+	msg.Status = StatusFailed
+	msg.Comment = ie.Error()
+	zlog.Warn("message skipped without valid recipient",
+		zap.String("txnno", msg.TxnNo),
+		zap.Strings("recipients", ie.addresses),
+	)
+
+	if err := s.store.MarkInvalid(ctx, msg); err != nil {
+		zlog.Error("failed to mark message as invalid",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// failTemplate takes msg out of the queue as failed, its template cannot
+// be rendered.
+func (s *Service) failTemplate(ctx context.Context, zlog *zap.Logger, msg *Message, te *templateError) {
+	msg.Status = StatusFailed
+	msg.Comment = te.Error()
+	zlog.Warn("message failed, template cannot be rendered", zap.String("txnno", msg.TxnNo), zap.Error(te))
+
+	if err := s.store.MarkInvalid(ctx, msg); err != nil {
+		zlog.Error("failed to mark message as failed",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// dropOverCap takes msg out of the queue as failed, a recipient having
+// reached the daily cap.
+func (s *Service) dropOverCap(ctx context.Context, zlog *zap.Logger, msg *Message, reason string) {
+	msg.Status = StatusFailed
+	msg.Comment = reason
+	zlog.Warn("message dropped over the daily recipient cap", zap.String("txnno", msg.TxnNo), zap.String("reason", reason))
+
+	if err := s.store.MarkInvalid(ctx, msg); err != nil {
+		zlog.Error("failed to mark message as failed",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// markDuplicate takes msg out of the queue as a duplicate of a recent send.
+func (s *Service) markDuplicate(ctx context.Context, zlog *zap.Logger, msg *Message) {
+	msg.Status = StatusDuplicate
+	msg.Comment = "duplicate of a message sent to the same recipients recently"
+	zlog.Warn("message skipped as duplicate", zap.String("txnno", msg.TxnNo))
+
+	if err := s.store.MarkDuplicate(ctx, msg); err != nil {
+		zlog.Error("failed to mark message as duplicate",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// Statuses stored in the rectype column.
+const (
+	StatusAdd         = "ADD"
+	StatusSending     = "SENDING"
+	StatusSent        = "SEND"
+	StatusFailed      = "FAILED"
+	StatusQuarantined = "QUARANTINED"
+	// StatusDuplicate is a message not sent because its recipients got the
+	// same one shortly before.
+	StatusDuplicate = "DUPLICATE"
+	// StatusFlagged is a message that cannot be sent as it is, e.g. over
+	// the size limit, with the reason in its comments. It is out of the
+	// queue until fixed and moved back to StatusAdd by hand.
+	StatusFlagged = "FLAGGED"
+)
+
+// Content types stored in the contenttype column.
+const (
+	ContentTypeHTML  = "text/html"
+	ContentTypePlain = "text/plain"
+)
+
 type Message struct {
 	ID     int64
 	TxnNo  string
@@ -119,23 +1327,229 @@ type Message struct {
 	Time    string
 	Subject string
 	Content string
+	// ContentType is the type of Content, ContentTypeHTML when empty.
+	ContentType string
 
-	// One of "SEND", "ADD"
+	// One of the Status constants
 	Status       string
 	Comment      string
 	ToAddresses  []string
+	CCAddresses  []string
 	BCCAddresses []string
 	SentAt       *time.Time
+	// Attempts is the number of times the message was claimed for
+	// sending, the current one included, set by MarkSending.
+	Attempts int
+
+	// From is the sender of this message, over the one of its rule when
+	// set.
+	From string
+	// ReplyTo is where the replies to this message go, over the reply_to
+	// of its rule when set.
+	ReplyTo string
+
+	// Priority is PriorityHigh, PriorityNormal or PriorityLow. It orders
+	// the queue and can route the message to a dedicated relay.
+	Priority string
+
+	// Locale is the locale dates are written in, e.g. "lo" or "en-US",
+	// the configured default when empty.
+	Locale string
+
+	// Amount is the monetary value of the underlying transaction, if any,
+	// checked against the CC thresholds.
+	Amount *float64
+
+	// AttachmentURL is the location of a file fetched and attached when
+	// the message is sent.
+	AttachmentURL string
+	// Attachments are stored in dbo.tb_emailAttachment, with their
+	// content or the path of a file read when the message is sent.
+	Attachments []Attachment
+
+	// RequestReadReceipt asks the recipient client for a read receipt
+	// (Disposition-Notification-To).
+	RequestReadReceipt bool
+	// RequestDeliveryReceipt asks the receiving server for a delivery
+	// receipt (Return-Receipt-To).
+	RequestDeliveryReceipt bool
+
+	// Template names the template of MAIL_TEMPLATE_DIR the subject and
+	// content are rendered from, with the JSON of TemplateData. Subject
+	// and Content are sent as they are without one.
+	Template     string
+	TemplateData string
+
+	// rule is the effective settings of the message, resolved from RuleID
+	// by prepare.
+	rule rule
+	// trace is the trace context of the send, set by prepare when
+	// TraceHeaders is on.
+	trace traceContext
+}
+
+// populateQueue runs pd_wiseSendEmail, which fills tb_getEmailWiseSend,
+// unless it already ran within procMinInterval.
+func (s *Service) populateQueue(ctx context.Context) error {
+	s.procMu.Lock()
+	defer s.procMu.Unlock()
+
+	if s.procMinInterval > 0 && !s.procLastRun.IsZero() && time.Since(s.procLastRun) < s.procMinInterval {
+		return nil
+	}
+
+	backoff := s.procRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.store.Populate(ctx)
+		if err == nil {
+			break
+		}
+		if attempt >= s.procRetryAttempts || !isContention(err) || ctx.Err() != nil {
+			return err
+		}
+
+		s.zlog.Warn("retrying pd_wiseSendEmail",
+			zap.String("service", "sender"),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to execute stored procedure pd_wiseSendEmail: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	s.procLastRun = time.Now()
+	return nil
+}
+
+// EscapeContent reports whether the content is plain text that must be
+// HTML-escaped before being wrapped in the HTML body. Raw HTML content is
+// left untouched.
+func (m *Message) EscapeContent() bool {
+	mediaType, _, _ := mime.ParseMediaType(m.ContentType)
+	return mediaType == ContentTypePlain
 }
 
-func listMailMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
-	_, err := db.ExecContext(ctx, "EXEC dbo.pd_wiseSendEmail")
+// Populate runs pd_wiseSendEmail, which fills tb_getEmailWiseSend.
+func (db *sqlStore) Populate(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, "EXEC dbo.pd_wiseSendEmail"); err != nil {
+		return fmt.Errorf("failed to execute stored procedure pd_wiseSendEmail: %w", err)
+	}
+	return nil
+}
+
+func (db *sqlStore) List(ctx context.Context, filter RuleFilter) ([]*Message, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultBatchSize
+	}
+
+	b := selectMessages(db).
+		Options(fmt.Sprintf("TOP %d", limit)).
+		Where(sq.Eq{"rectype": StatusAdd})
+	if db.features.Priorities {
+		b = b.OrderBy(fmt.Sprintf("CASE priority WHEN '%s' THEN 0 WHEN '%s' THEN 2 ELSE 1 END", PriorityHigh, PriorityLow))
+	}
+	b = b.OrderBy("TWID ASC")
+
+	if filter.IncludeBCCOnly {
+		b = b.Where(sq.Or{
+			sq.NotEq{"toaddress": nil},
+			sq.NotEq{"bccaddress": nil},
+		})
+	} else {
+		b = b.Where(sq.NotEq{"toaddress": nil})
+	}
+
+	if len(filter.TxnNos) > 0 {
+		b = b.Where(sq.Eq{"Txnno": filter.TxnNos})
+	} else {
+		b = b.Where(sq.Eq{"txtdate": time.Now().Format("2006-01-02")})
+	}
+
+	if len(filter.RuleIDs) > 0 {
+		b = b.Where(sq.Eq{"Ruleid": filter.RuleIDs})
+	}
+	if len(filter.ExcludeRuleIDs) > 0 {
+		b = b.Where(sq.NotEq{"Ruleid": filter.ExcludeRuleIDs})
+	}
+	for _, p := range db.predicates {
+		b = b.Where(p)
+	}
+
+	return queryMessages(ctx, db, b)
+}
+
+// MissingTxnNos returns the txnNos without any message, whatever its
+// status.
+func (db *sqlStore) MissingTxnNos(ctx context.Context, txnNos []string) ([]string, error) {
+	q, args := db.sb.Select("DISTINCT Txnno").
+		From("dbo.tb_getEmailWiseSend").
+		Where(sq.Eq{"Txnno": txnNos}).
+		MustSql()
+
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tb_getEmailWiseSend: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool, len(txnNos))
+	for rows.Next() {
+		var txnNo string
+		if err := rows.Scan(&txnNo); err != nil {
+			return nil, fmt.Errorf("failed to scan tb_getEmailWiseSend: %w", err)
+		}
+		found[txnNo] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan tb_getEmailWiseSend: %w", err)
+	}
+
+	missing := make([]string, 0)
+	for _, txnNo := range txnNos {
+		if !found[txnNo] {
+			missing = append(missing, txnNo)
+		}
+	}
+	return missing, nil
+}
+
+// Get returns the message with the given txnNo, whatever its status, or
+// nil when there is none.
+func (db *sqlStore) Get(ctx context.Context, txnNo string) (*Message, error) {
+	ms, err := queryMessages(ctx, db, selectMessages(db).
+		Options("TOP 1").
+		Where(sq.Eq{"Txnno": txnNo}).
+		OrderBy("TWID DESC"),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute stored procedure pd_wiseSendEmail: %w", err)
+		return nil, err
+	}
+	if len(ms) == 0 {
+		return nil, nil
 	}
+	return ms[0], nil
+}
+
+// selectMessages returns a query selecting the columns scanned by
+// queryMessages. The columns of the schema features turned off are
+// selected as NULL, the table may not have them.
+func selectMessages(db *sqlStore) sq.SelectBuilder {
+	optional := func(on bool, column string) string {
+		if on {
+			return column
+		}
+		return "NULL AS " + column
+	}
+	f := db.features
 
-	q, args := sq.Select(
-		"TOP 100 TWID",
+	return db.sb.Select(
+		"TWID",
 		"Txnno",
 		"Ruleid",
 		"txtdate",
@@ -146,19 +1560,23 @@ func listMailMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
 		"rectype",
 		"senddatetime",
 		"comments",
+		optional(f.Attachments, "attachmenturl"),
+		optional(f.Receipts, "readreceipt"),
+		optional(f.Receipts, "deliveryreceipt"),
+		optional(f.ContentTypes, "contenttype"),
+		optional(f.Amounts, "amount"),
+		optional(f.Locales, "locale"),
+		optional(f.Priorities, "priority"),
+		optional(f.FromOverrides, "fromaddress"),
+		optional(f.FromOverrides, "replytoaddress"),
+		optional(f.Templates, "templatename"),
+		optional(f.Templates, "templatedata"),
 	).
-		From("dbo.tb_getEmailWiseSend").
-		PlaceholderFormat(sq.AtP).
-		Where(
-			sq.Eq{
-				"rectype": "ADD",
-				"txtdate": time.Now().Format("2006-01-02"),
-			},
-			sq.NotEq{
-				"toaddress": nil,
-			}).
-		OrderBy("TWID ASC").
-		MustSql()
+		From("dbo.tb_getEmailWiseSend")
+}
+
+func queryMessages(ctx context.Context, db *sqlStore, b sq.SelectBuilder) ([]*Message, error) {
+	q, args := b.MustSql()
 
 	rows, err := db.QueryContext(ctx, q, args...)
 	if err != nil {
@@ -169,7 +1587,11 @@ func listMailMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
 	ms := make([]*Message, 0)
 	for rows.Next() {
 		var m Message
-		var rawToAddress, rowBccAddress sql.NullString
+		var rawToAddress, rowBccAddress, attachmentURL, contentType sql.NullString
+		var readReceipt, deliveryReceipt sql.NullBool
+		var amount sql.NullFloat64
+		var locale, priority, from, replyTo sql.NullString
+		var templateName, templateData sql.NullString
 		if err := rows.Scan(
 			&m.ID,
 			&m.TxnNo,
@@ -182,6 +1604,17 @@ func listMailMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
 			&m.Status,
 			&m.SentAt,
 			&m.Comment,
+			&attachmentURL,
+			&readReceipt,
+			&deliveryReceipt,
+			&contentType,
+			&amount,
+			&locale,
+			&priority,
+			&from,
+			&replyTo,
+			&templateName,
+			&templateData,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan tb_getEmailWiseSend: %w", err)
 		}
@@ -201,11 +1634,31 @@ func listMailMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
 
 		}
 
+		m.AttachmentURL = attachmentURL.String
+		m.RequestReadReceipt = readReceipt.Bool
+		m.RequestDeliveryReceipt = deliveryReceipt.Bool
+		m.ContentType = contentType.String
+		if amount.Valid {
+			m.Amount = &amount.Float64
+		}
+		m.Locale = locale.String
+		m.Priority = normalizePriority(priority.String)
+		m.From = strings.TrimSpace(from.String)
+		m.ReplyTo = strings.TrimSpace(replyTo.String)
+		m.Template = strings.TrimSpace(templateName.String)
+		m.TemplateData = templateData.String
+
 		ms = append(ms, &m)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("failed to iterate tb_getEmailWiseSend: %w", err)
 	}
 
+	if !db.features.Attachments {
+		return ms, nil
+	}
+	if err := db.loadAttachments(ctx, ms); err != nil {
+		return nil, err
+	}
 	return ms, nil
 }
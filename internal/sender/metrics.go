@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "sendingemail"
+
+var (
+	smtpPoolInUse = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "smtp_pool",
+		Name:      "connections_in_use",
+		Help:      "Number of SMTP connections currently sending, by SMTP profile. The default one is labeled \"default\".",
+	}, []string{"profile"})
+	smtpPoolIdle = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "smtp_pool",
+		Name:      "connections_idle",
+		Help:      "Number of idle SMTP connections kept for reuse, by SMTP profile. The default one is labeled \"default\".",
+	}, []string{"profile"})
+	smtpPoolDials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "smtp_pool",
+		Name:      "dials_total",
+		Help:      "Number of new SMTP connections dialed, by SMTP profile. The default one is labeled \"default\".",
+	}, []string{"profile"})
+	smtpPoolReuses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "smtp_pool",
+		Name:      "reuses_total",
+		Help:      "Number of sends that reused an idle SMTP connection, by SMTP profile. The default one is labeled \"default\".",
+	}, []string{"profile"})
+	senderPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "paused",
+		Help:      "1 while sending is auto-paused after a spike of failures.",
+	})
+	senderAutoPauses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "auto_pauses_total",
+		Help:      "Number of times sending was auto-paused.",
+	})
+	senderFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "failures_total",
+		Help:      "Number of messages failed, flagged or quarantined, by rule. Rules missing from the rule config are counted as \"other\".",
+	}, []string{"rule_id"})
+	senderHeartbeat = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "last_tick_timestamp_seconds",
+		Help:      "Time the last send run finished listing the queue, empty or not.",
+	})
+	senderLastSent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "last_sent_timestamp_seconds",
+		Help:      "Time the last send run delivered at least one message.",
+	})
+	senderSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "messages_sent_total",
+		Help:      "Number of messages accepted by the relay.",
+	})
+	senderSendFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "messages_failed_total",
+		Help:      "Number of messages the relay did not accept, transient failures included.",
+	})
+	senderRunDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the send runs, from listing the queue to marking the messages.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+	senderQueueSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "queue_size",
+		Help:      "Number of queued messages picked up by the last send run.",
+	})
+	senderLockTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "lock_timeouts_total",
+		Help:      "Number of send runs skipped after waiting too long for the one in progress.",
+	})
+	senderUnreconciled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sender",
+		Name:      "messages_unreconciled_total",
+		Help:      "Number of messages delivered but not marked as sent, left for an operator to reconcile.",
+	})
+)
+
+// RegisterMetrics registers the sender metrics with reg.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		smtpPoolInUse,
+		smtpPoolIdle,
+		smtpPoolDials,
+		smtpPoolReuses,
+		senderPaused,
+		senderAutoPauses,
+		senderFailures,
+		senderHeartbeat,
+		senderLastSent,
+		senderSent,
+		senderSendFailed,
+		senderRunDuration,
+		senderQueueSize,
+		senderUnreconciled,
+		senderLockTimeouts,
+	}
+
+	var errs []error
+	for _, c := range collectors {
+		errs = append(errs, reg.Register(c))
+	}
+	return errors.Join(errs...)
+}
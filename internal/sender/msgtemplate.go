@@ -0,0 +1,193 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// messageTemplate renders the subject and content of the messages naming
+// it in their templatename column, from the JSON of their templatedata
+// column. It is read from MAIL_TEMPLATE_DIR: <name>.subject, and either
+// <name>.html, escaped as HTML, or <name>.txt for plain-text content. An
+// optional <name>.sample.json is the templatedata it is validated with.
+type messageTemplate struct {
+	subject *template.Template
+	html    *htmltemplate.Template
+	text    *template.Template
+	// sample is the data of <name>.sample.json, nil without one.
+	sample map[string]any
+}
+
+// messageTemplateData is the data the message templates are executed
+// with, e.g. "{{.Data.customer.name}}" or "{{formatDate .Date}}".
+type messageTemplateData struct {
+	TxnNo  string
+	RuleID string
+	Date   string
+	// Data is the templatedata of the message.
+	Data map[string]any
+}
+
+// templateError is returned by prepare for a message whose template
+// cannot be rendered, it is failed rather than sent half rendered.
+type templateError struct {
+	name string
+	err  error
+}
+
+func (e *templateError) Error() string {
+	return fmt.Sprintf("template %q: %s", e.name, e.err)
+}
+
+func (e *templateError) Unwrap() error {
+	return e.err
+}
+
+// loadMessageTemplates parses the templates of dir, none when it is
+// empty. A missing key fails the render instead of writing "<no value>".
+func loadMessageTemplates(dir string) (map[string]*messageTemplate, error) {
+	templates := make(map[string]*messageTemplate)
+	if dir == "" {
+		return templates, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.subject"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list MAIL_TEMPLATE_DIR: %w", err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".subject")
+		t, err := loadMessageTemplate(dir, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load template %q: %w", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+func loadMessageTemplate(dir, name string) (*messageTemplate, error) {
+	base := filepath.Join(dir, name)
+	funcs := templateFuncs(defaultLocale)
+
+	subject, err := os.ReadFile(base + ".subject")
+	if err != nil {
+		return nil, err
+	}
+	t := &messageTemplate{}
+	t.subject, err = template.New(name + ".subject").Option("missingkey=error").Funcs(funcs).Parse(strings.TrimSpace(string(subject)))
+	if err != nil {
+		return nil, err
+	}
+
+	if sample, err := os.ReadFile(base + ".sample.json"); err == nil {
+		if err := json.Unmarshal(sample, &t.sample); err != nil {
+			return nil, fmt.Errorf("invalid %s.sample.json: %w", name, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if content, err := os.ReadFile(base + ".html"); err == nil {
+		t.html, err = htmltemplate.New(name + ".html").Option("missingkey=error").Funcs(htmltemplate.FuncMap(funcs)).Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(base + ".txt")
+	if err != nil {
+		return nil, fmt.Errorf("missing %s.html or %s.txt: %w", name, name, err)
+	}
+	t.text, err = template.New(name + ".txt").Option("missingkey=error").Funcs(funcs).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// renderTemplate replaces the subject and content of msg with its template
+// rendered from its data. A message without template keeps its content.
+func (s *Service) renderTemplate(msg *Message) error {
+	if msg.Template == "" {
+		return nil
+	}
+
+	t, ok := s.templates[msg.Template]
+	if !ok {
+		return &templateError{name: msg.Template, err: errors.New("no such template")}
+	}
+
+	data := messageTemplateData{
+		TxnNo:  msg.TxnNo,
+		RuleID: msg.RuleID,
+		Date:   msg.Time,
+	}
+	if strings.TrimSpace(msg.TemplateData) != "" {
+		if err := json.Unmarshal([]byte(msg.TemplateData), &data.Data); err != nil {
+			return &templateError{name: msg.Template, err: fmt.Errorf("invalid data: %w", err)}
+		}
+	}
+
+	subject, content, err := t.render(msg.Locale, data)
+	if err != nil {
+		return &templateError{name: msg.Template, err: err}
+	}
+
+	msg.Subject = subject
+	msg.Content = content
+	msg.ContentType = t.contentType()
+	return nil
+}
+
+// render executes the subject and the content of t with data.
+func (t *messageTemplate) render(locale string, data messageTemplateData) (subject, content string, err error) {
+	subject, err = executeLocale(t.subject, locale, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	if t.html != nil {
+		content, err = t.renderHTML(locale, data)
+	} else {
+		content, err = executeLocale(t.text, locale, data)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return subject, content, nil
+}
+
+// contentType is the type of the content t renders.
+func (t *messageTemplate) contentType() string {
+	if t.html != nil {
+		return ContentTypeHTML
+	}
+	return ContentTypePlain
+}
+
+// renderHTML executes the HTML content with the template functions of
+// locale, on a clone like executeLocale: the parsed template itself is
+// never executed, which would forbid cloning it.
+func (t *messageTemplate) renderHTML(locale string, data messageTemplateData) (string, error) {
+	c, err := t.html.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to clone template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Funcs(htmltemplate.FuncMap(templateFuncs(locale))).Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", c.Name(), err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,110 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mxResolver is the subset of *net.Resolver used to check recipient
+// domains.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// mxChecker tells whether a recipient domain can receive mail, i.e. has a
+// MX record or, failing that, an address record. Answers are cached for
+// ttl so a batch only looks every domain up once.
+type mxChecker struct {
+	resolver mxResolver
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mxEntry
+}
+
+type mxEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+func newMXChecker(resolver mxResolver, timeout, ttl time.Duration) *mxChecker {
+	return &mxChecker{
+		resolver: resolver,
+		timeout:  timeout,
+		ttl:      ttl,
+		cache:    make(map[string]mxEntry),
+	}
+}
+
+// filter splits addrs into the ones whose domain can receive mail and the
+// ones whose domain does not exist or has no mail server. Lookups failing
+// for another reason (e.g. a timeout) keep the address, the relay is the
+// one to decide then.
+func (c *mxChecker) filter(ctx context.Context, addrs []string) (kept, dropped []string) {
+	kept = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		_, domain, ok := strings.Cut(addr, "@")
+		if !ok || c.hasMailServer(ctx, strings.ToLower(strings.TrimSpace(domain))) {
+			kept = append(kept, addr)
+			continue
+		}
+		dropped = append(dropped, addr)
+	}
+	return kept, dropped
+}
+
+func (c *mxChecker) hasMailServer(ctx context.Context, domain string) bool {
+	c.mu.Lock()
+	e, ok := c.cache[domain]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ok
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	found, err := c.lookup(ctx, domain)
+	if err != nil {
+		return true
+	}
+
+	c.mu.Lock()
+	c.cache[domain] = mxEntry{ok: found, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return found
+}
+
+// lookup reports whether domain has a MX or address record. err is only
+// set when the answer is unknown.
+func (c *mxChecker) lookup(ctx context.Context, domain string) (bool, error) {
+	mxs, err := c.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		// A null MX (RFC 7505) explicitly refuses mail.
+		return !(len(mxs) == 1 && mxs[0].Host == "."), nil
+	}
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+
+	hosts, err := c.resolver.LookupHost(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(hosts) > 0, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,66 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPublisher publishes the events to a subject of a NATS server: fire
+// and forget, no JetStream acknowledgement. The client connects and
+// reconnects in the background, the events published meanwhile are
+// buffered up to its reconnect buffer.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+	timeout time.Duration
+}
+
+var _ EventPublisher = (*natsPublisher)(nil)
+
+func newNATSPublisher(rawURL, subject string, timeout time.Duration) (*natsPublisher, error) {
+	conn, err := nats.Connect(rawURL,
+		nats.Name("sendingemail"),
+		nats.Timeout(timeout),
+		nats.FlusherTimeout(timeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+
+	return &natsPublisher{
+		conn:    conn,
+		subject: subject,
+		timeout: timeout,
+	}, nil
+}
+
+// Publish hands e as JSON to the client, it is written to the server in
+// the background.
+func (p *natsPublisher) Publish(_ context.Context, e BusEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if err := p.conn.Publish(p.subject, payload); err != nil {
+		return fmt.Errorf("failed to publish to nats: %w", err)
+	}
+	return nil
+}
+
+// Close writes the buffered events, waiting up to the timeout, and closes
+// the connection.
+func (p *natsPublisher) Close() error {
+	defer p.conn.Close()
+
+	if !p.conn.IsConnected() {
+		return nil
+	}
+	return p.conn.FlushTimeout(p.timeout)
+}
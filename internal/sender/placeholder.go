@@ -0,0 +1,32 @@
+package sender
+
+import (
+	"html"
+	"strings"
+)
+
+// expandPlaceholders replaces the {{TxnNo}}, {{Date}} and {{RuleID}}
+// placeholders of the subject and content of msg with its own fields, the
+// date written in its locale. It is lighter than the templates: nothing
+// else of the text is interpreted.
+func expandPlaceholders(msg *Message) {
+	date, err := formatDate(msg.Locale, msg.Time)
+	if err != nil {
+		date = msg.Time
+	}
+	values := []string{
+		"{{TxnNo}}", msg.TxnNo,
+		"{{Date}}", date,
+		"{{RuleID}}", msg.RuleID,
+	}
+	msg.Subject = strings.NewReplacer(values...).Replace(msg.Subject)
+
+	if !msg.EscapeContent() {
+		// Plain text content is escaped as a whole later, HTML content
+		// only gets escaped values.
+		for i := 1; i < len(values); i += 2 {
+			values[i] = html.EscapeString(values[i])
+		}
+	}
+	msg.Content = strings.NewReplacer(values...).Replace(msg.Content)
+}
@@ -0,0 +1,308 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	netmail "net/mail"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/mail.v2"
+)
+
+// dialerPool hands out SMTP connections while capping how many of them are
+// open at the same time, so concurrent sends never exceed the footprint the
+// relay allows. Connections are kept after a successful send and reused
+// until they have been idle for longer than idleTimeout.
+type dialerPool struct {
+	dialer      dialer
+	sem         chan struct{}
+	idleTimeout time.Duration
+	metrics     poolMetrics
+
+	mu   sync.Mutex
+	idle []*pooledConn
+}
+
+// Dialer hands messages to a relay. Every SMTP profile gets a pooled one
+// built from the environment, Service.SetDialer replaces it, e.g. with a
+// fake in tests.
+type Dialer interface {
+	DialAndSend(msgs ...*mail.Message) error
+}
+
+// envelopeDialer is a Dialer able to send a message to other recipients
+// than the ones of its headers, needed by the messages split for having
+// too many recipients.
+type envelopeDialer interface {
+	Dialer
+	DialAndSendTo(m *mail.Message, to []string) error
+}
+
+var _ envelopeDialer = (*dialerPool)(nil)
+
+// dialer opens an authenticated connection to a relay.
+type dialer interface {
+	Dial() (mail.SendCloser, error)
+}
+
+type pooledConn struct {
+	mail.SendCloser
+	lastUsed time.Time
+}
+
+// poolMetrics are the pool metrics labeled with the SMTP profile of a
+// pool, so that the pools of the profiles do not overwrite each other.
+type poolMetrics struct {
+	inUse  prometheus.Gauge
+	idle   prometheus.Gauge
+	dials  prometheus.Counter
+	reuses prometheus.Counter
+}
+
+// defaultProfileLabel is the profile label of the pool of the default
+// relay.
+const defaultProfileLabel = "default"
+
+func newPoolMetrics(profile string) poolMetrics {
+	if profile == "" {
+		profile = defaultProfileLabel
+	}
+	return poolMetrics{
+		inUse:  smtpPoolInUse.WithLabelValues(profile),
+		idle:   smtpPoolIdle.WithLabelValues(profile),
+		dials:  smtpPoolDials.WithLabelValues(profile),
+		reuses: smtpPoolReuses.WithLabelValues(profile),
+	}
+}
+
+// PoolStats is a snapshot of the SMTP connection pool.
+type PoolStats struct {
+	MaxConns int
+	InUse    int
+	Idle     int
+}
+
+func newDialerPool(profile string, d dialer, maxConns int, idleTimeout time.Duration) *dialerPool {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+
+	return &dialerPool{
+		dialer:      d,
+		sem:         make(chan struct{}, maxConns),
+		idleTimeout: idleTimeout,
+		metrics:     newPoolMetrics(profile),
+	}
+}
+
+// DialAndSend sends msgs over a pooled connection, blocking while the
+// maximum number of connections is in use.
+func (p *dialerPool) DialAndSend(msgs ...*mail.Message) error {
+	return p.do(func(s mail.Sender) error {
+		return mail.Send(s, msgs...)
+	})
+}
+
+// DialAndSendTo is like DialAndSend for a single message delivered to the
+// envelope recipients to instead of the recipients of its headers.
+func (p *dialerPool) DialAndSendTo(m *mail.Message, to []string) error {
+	from, err := envelopeFrom(m)
+	if err != nil {
+		return err
+	}
+
+	return p.do(func(s mail.Sender) error {
+		if err := s.Send(from, to, m); err != nil {
+			return &mail.SendError{Cause: err}
+		}
+		return nil
+	})
+}
+
+// envelopeFrom returns the address m is sent from, the way mail.Send picks
+// it.
+func envelopeFrom(m *mail.Message) (string, error) {
+	from := m.GetHeader("Sender")
+	if len(from) == 0 {
+		from = m.GetHeader("From")
+	}
+	if len(from) == 0 {
+		return "", errors.New(`invalid message, "From" field is absent`)
+	}
+
+	addr, err := netmail.ParseAddress(from[0])
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
+
+// do runs send over a pooled connection. send reports its failures as a
+// *mail.SendError so that a dropped idle connection is told apart from a
+// message that went out.
+func (p *dialerPool) do(send func(s mail.Sender) error) error {
+	p.sem <- struct{}{}
+	p.metrics.inUse.Inc()
+	defer func() {
+		<-p.sem
+		p.metrics.inUse.Dec()
+	}()
+
+	conn, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = send(conn)
+	if err != nil && reused && isStaleConn(err) {
+		// The server dropped the idle connection before the first command,
+		// nothing went out on it. Any later failure, e.g. a timeout waiting
+		// for the reply to DATA, may come after the relay took the message,
+		// which would be delivered twice.
+		conn.Close()
+		if conn, err = p.dial(); err != nil {
+			return err
+		}
+		err = send(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.put(conn)
+	return nil
+}
+
+func (p *dialerPool) get() (*pooledConn, bool, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.metrics.idle.Set(float64(len(p.idle)))
+
+		if time.Since(conn.lastUsed) > p.idleTimeout {
+			conn.Close()
+			continue
+		}
+
+		p.mu.Unlock()
+		p.metrics.reuses.Inc()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+	return conn, false, err
+}
+
+func (p *dialerPool) dial() (*pooledConn, error) {
+	sc, err := p.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	p.metrics.dials.Inc()
+	return &pooledConn{SendCloser: sc}, nil
+}
+
+func (p *dialerPool) put(conn *pooledConn) {
+	conn.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle = append(p.idle, conn)
+	p.metrics.idle.Set(float64(len(p.idle)))
+}
+
+// Stats returns a snapshot of the pool usage.
+func (p *dialerPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolStats{
+		MaxConns: cap(p.sem),
+		InUse:    len(p.sem),
+		Idle:     len(p.idle),
+	}
+}
+
+// Close closes every idle connection.
+func (p *dialerPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for _, conn := range p.idle {
+		errs = append(errs, conn.Close())
+	}
+	p.idle = nil
+	p.metrics.idle.Set(0)
+
+	return errors.Join(errs...)
+}
+
+// CheckSMTP checks the default relay with a NOOP on an idle connection of
+// its pool, or else by opening one, upgraded to TLS and authenticated like
+// a send would. It takes a slot of the pool like a send, so a probe never
+// opens a connection more than the relay allows. It returns once ctx is
+// done, the check finishing in the background within the dialer timeout
+// and closing its connection. A replaced default dialer is not checked.
+func (s *Service) CheckSMTP(ctx context.Context) error {
+	p, ok := s.dialers[""].(*dialerPool)
+	if !ok {
+		return nil
+	}
+	return p.check(ctx)
+}
+
+// check waits for a slot of p and checks a connection in it, which is put
+// back idle unless ctx is done by then.
+func (p *dialerPool) check(ctx context.Context) error {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.metrics.inUse.Inc()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := p.checkConn()
+		if err == nil {
+			if ctx.Err() != nil {
+				conn.Close()
+			} else {
+				p.put(conn)
+			}
+		}
+		<-p.sem
+		p.metrics.inUse.Dec()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkConn returns an idle connection of p the relay answers a NOOP on,
+// or a new one.
+func (p *dialerPool) checkConn() (*pooledConn, error) {
+	conn, reused, err := p.get()
+	if err != nil || !reused {
+		return conn, err
+	}
+	if pc, ok := conn.SendCloser.(pinger); ok && pc.Noop() == nil {
+		return conn, nil
+	}
+	// Dead, or cannot be checked.
+	conn.Close()
+	return p.dial()
+}
@@ -0,0 +1,182 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// fakeConn is a connection of fakeRelay.
+type fakeConn struct {
+	relay *fakeRelay
+}
+
+func (c *fakeConn) Send(string, []string, io.WriterTo) error {
+	r := c.relay
+	r.mu.Lock()
+	r.sends++
+	var err error
+	if len(r.errs) > 0 {
+		err, r.errs = r.errs[0], r.errs[1:]
+	}
+	r.mu.Unlock()
+
+	time.Sleep(r.delay)
+	return err
+}
+
+func (c *fakeConn) Noop() error {
+	r := c.relay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.noops++
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	r := c.relay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.open--
+	return nil
+}
+
+// fakeRelay is a dialer counting the connections open at the same time.
+// The sends fail with errs in order, then succeed.
+type fakeRelay struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	errs    []error
+	open    int
+	maxOpen int
+	dials   int
+	sends   int
+	noops   int
+}
+
+func (r *fakeRelay) Dial() (mail.SendCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dials++
+	r.open++
+	r.maxOpen = max(r.maxOpen, r.open)
+	return &fakeConn{relay: r}, nil
+}
+
+func newTestMail() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("From", "noreply@example.com")
+	m.SetHeader("To", "a@example.com")
+	m.SetBody("text/plain", "hello")
+	return m
+}
+
+func TestDialerPoolCapsConnections(t *testing.T) {
+	relay := &fakeRelay{delay: 10 * time.Millisecond}
+	p := newDialerPool("", relay, 2, time.Minute)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.DialAndSend(newTestMail()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if relay.maxOpen > 2 {
+		t.Errorf("%d connections open at once, want at most 2", relay.maxOpen)
+	}
+	if relay.sends != 10 {
+		t.Errorf("relay got %d messages, want 10", relay.sends)
+	}
+	if st := p.Stats(); st.InUse != 0 || st.Idle > 2 {
+		t.Errorf("Stats() = %+v, want no connection in use and at most 2 idle", st)
+	}
+}
+
+func TestDialerPoolRetriesStaleConnection(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantSends int
+		wantErr   bool
+	}{
+		{
+			name:      "closed before the first command",
+			err:       firstCmdErr(io.EOF),
+			wantSends: 2,
+		},
+		{
+			name:      "timeout after DATA",
+			err:       os.ErrDeadlineExceeded,
+			wantSends: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := &fakeRelay{}
+			p := newDialerPool("", relay, 1, time.Minute)
+			if err := p.DialAndSend(newTestMail()); err != nil {
+				t.Fatal(err)
+			}
+
+			relay.errs = []error{tt.err}
+			relay.sends = 0
+			err := p.DialAndSend(newTestMail())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DialAndSend() error = %v, want error %v", err, tt.wantErr)
+			}
+			if relay.sends != tt.wantSends {
+				t.Errorf("relay got the message %d times, want %d", relay.sends, tt.wantSends)
+			}
+		})
+	}
+}
+
+func TestCheckWaitsForASlot(t *testing.T) {
+	relay := &fakeRelay{}
+	p := newDialerPool("", relay, 1, time.Minute)
+	p.sem <- struct{}{} // a send holds the only connection
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("check() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if relay.dials != 0 {
+		t.Errorf("check() dialed %d times while the pool was full, want 0", relay.dials)
+	}
+}
+
+func TestCheckReusesIdleConnection(t *testing.T) {
+	relay := &fakeRelay{}
+	p := newDialerPool("", relay, 1, time.Minute)
+	if err := p.DialAndSend(newTestMail()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.check(context.Background()); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if relay.dials != 1 || relay.noops != 1 {
+		t.Errorf("relay got %d dials and %d NOOPs, want the idle connection checked with a NOOP", relay.dials, relay.noops)
+	}
+	if st := p.Stats(); st.InUse != 0 || st.Idle != 1 {
+		t.Errorf("Stats() = %+v, want the connection back idle", st)
+	}
+}
@@ -0,0 +1,124 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// predicateColumns are the columns of dbo.tb_getEmailWiseSend a selection
+// predicate can always test. SEND_SELECT_COLUMNS adds the ones of the
+// deployment, e.g. a branch code.
+var predicateColumns = []string{
+	"Ruleid", "priority", "locale", "contenttype", "amount", "fromaddress",
+}
+
+// columnName matches the names accepted for SEND_SELECT_COLUMNS, which are
+// written into the statement as is.
+var columnName = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// predicateOperators are the operators of a selection predicate, the
+// longer ones first so "<=" is not read as "<".
+var predicateOperators = []string{"not in ", "in ", "<=", ">=", "<>", "!=", "=", "<", ">"}
+
+// parsePredicates parses the selection predicates of SEND_SELECT: entries
+// like "branchcode = 001" or "priority in HIGH,NORMAL" separated by ";".
+// The column must be allowed, either a predicateColumns one or one of
+// extraColumns, a comma separated list. The values are bound, never
+// written into the statement.
+func parsePredicates(spec, extraColumns string) ([]sq.Sqlizer, error) {
+	allowed := make(map[string]string)
+	for _, c := range predicateColumns {
+		allowed[strings.ToLower(c)] = c
+	}
+	for _, c := range strings.Split(extraColumns, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !columnName.MatchString(c) {
+			return nil, fmt.Errorf("invalid SEND_SELECT_COLUMNS column name %q", c)
+		}
+		allowed[strings.ToLower(c)] = c
+	}
+
+	var preds []sq.Sqlizer
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		p, err := parsePredicate(entry, allowed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SEND_SELECT predicate %q: %w", entry, err)
+		}
+		preds = append(preds, p)
+	}
+	return preds, nil
+}
+
+func parsePredicate(entry string, allowed map[string]string) (sq.Sqlizer, error) {
+	end := strings.IndexFunc(entry, func(r rune) bool {
+		return !(r == '_' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+	})
+	if end <= 0 {
+		return nil, errors.New("missing column")
+	}
+	column, ok := allowed[strings.ToLower(entry[:end])]
+	if !ok {
+		return nil, fmt.Errorf("column %q is not allowed", entry[:end])
+	}
+
+	rest := strings.TrimSpace(entry[end:])
+	for _, op := range predicateOperators {
+		if len(rest) < len(op) || !strings.EqualFold(rest[:len(op)], op) {
+			continue
+		}
+		value := strings.TrimSpace(rest[len(op):])
+		if value == "" {
+			return nil, errors.New("missing value")
+		}
+
+		switch strings.TrimSpace(op) {
+		case "in", "not in":
+			values := strings.Split(value, ",")
+			for i, v := range values {
+				values[i] = strings.TrimSpace(v)
+				if values[i] == "" {
+					return nil, errors.New("empty value in list")
+				}
+			}
+			if op == "in " {
+				return sq.Eq{column: values}, nil
+			}
+			return sq.NotEq{column: values}, nil
+		case "=":
+			return sq.Eq{column: value}, nil
+		case "!=", "<>":
+			return sq.NotEq{column: value}, nil
+		case "<":
+			return sq.Lt{column: value}, nil
+		case "<=":
+			return sq.LtOrEq{column: value}, nil
+		case ">":
+			return sq.Gt{column: value}, nil
+		case ">=":
+			return sq.GtOrEq{column: value}, nil
+		}
+	}
+	return nil, errors.New("unsupported operator, want one of =, !=, <>, <, <=, >, >=, in, not in")
+}
+
+// setPredicates sets the predicates List applies on top of its own.
+func (db *sqlStore) setPredicates(spec, extraColumns string) error {
+	preds, err := parsePredicates(spec, extraColumns)
+	if err != nil {
+		return err
+	}
+	db.predicates = preds
+	return nil
+}
@@ -0,0 +1,98 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventBounced is a bounce reported by the relay, only published.
+const EventBounced = "bounced"
+
+// EventPublisher emits the outcome of the messages to a message bus, for
+// the services that consume events rather than webhooks.
+type EventPublisher interface {
+	Publish(ctx context.Context, e BusEvent) error
+}
+
+// BusEvent is what the message bus gets for a sent, retried or failed
+// message and for a bounce, as JSON.
+type BusEvent struct {
+	// Type is EventSent, EventRetried, EventFailed or EventBounced.
+	Type   string `json:"type"`
+	TxnNo  string `json:"txn_no,omitempty"`
+	RuleID string `json:"rule_id,omitempty"`
+	RunID  string `json:"run_id,omitempty"`
+	// Recipient and Class describe a bounce.
+	Recipient string      `json:"recipient,omitempty"`
+	Class     BounceClass `json:"class,omitempty"`
+	Detail    string      `json:"detail,omitempty"`
+	At        time.Time   `json:"at"`
+}
+
+func newBusEvent(ctx context.Context, msg *Message, typ, detail string) BusEvent {
+	return BusEvent{
+		Type:   typ,
+		TxnNo:  msg.TxnNo,
+		RuleID: msg.RuleID,
+		RunID:  RunID(ctx),
+		Detail: detail,
+		At:     time.Now(),
+	}
+}
+
+// noopPublisher drops the events, it is the publisher without a bus.
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, BusEvent) error {
+	return nil
+}
+
+// newEventPublisher returns the publisher of the bus at rawURL, the no-op
+// one when it is empty. Only NATS, nats://[user:password@]host:port, is
+// supported.
+func newEventPublisher(rawURL, subject string, timeout time.Duration) (EventPublisher, error) {
+	if rawURL == "" {
+		return noopPublisher{}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENT_BUS_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "nats":
+		return newNATSPublisher(rawURL, subject, timeout)
+	default:
+		return nil, fmt.Errorf("unsupported EVENT_BUS_URL scheme %q, only nats is", u.Scheme)
+	}
+}
+
+// SetEventPublisher replaces the publisher of the events, e.g. with an
+// in-memory one in tests. The replaced publisher is not closed.
+func (s *Service) SetEventPublisher(p EventPublisher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.publisher = p
+}
+
+// publish emits events. The bus is a side channel, a failure is logged and
+// does not stop the send. The first failure drops the rest of events, the
+// bus is most likely unreachable.
+func (s *Service) publish(ctx context.Context, zlog *zap.Logger, events ...BusEvent) {
+	for i, e := range events {
+		if err := s.publisher.Publish(ctx, e); err != nil {
+			zlog.Error("failed to publish message events",
+				zap.String("txnno", e.TxnNo),
+				zap.String("type", e.Type),
+				zap.Int("dropped", len(events)-i),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+}
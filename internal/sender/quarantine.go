@@ -0,0 +1,42 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// quarantine takes msg out of the queue for good after it caused a panic,
+// keeping the panic detail in the comments column for investigation.
+func (s *Service) quarantine(ctx context.Context, zlog *zap.Logger, msg *Message, pe *panicError) {
+	zlog.Error("message quarantined after panic",
+		zap.String("txnno", msg.TxnNo),
+		zap.Any("panic", pe.value),
+		zap.ByteString("stack", pe.stack),
+	)
+
+	msg.Status = StatusQuarantined
+	msg.Comment = pe.Error()
+
+	if err := s.store.Quarantine(ctx, msg); err != nil {
+		zlog.Error("failed to quarantine message",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+func (db *sqlStore) Quarantine(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusQuarantined).
+		Set("comments", msg.Comment).
+		Where(sq.Eq{"TWID": msg.ID}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to quarantine message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// RecipientResolver expands internal group codes (e.g. "@finance-team")
+// stored in the address columns into the addresses of their members.
+type RecipientResolver interface {
+	// Resolve returns addrs with every group code replaced by its members.
+	// Group codes without any member are returned in unresolved.
+	Resolve(ctx context.Context, addrs []string) (resolved, unresolved []string, err error)
+}
+
+// isGroupCode reports whether addr is a group code rather than a mailbox.
+func isGroupCode(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+type sqlRecipientResolver struct {
+	db *sqlStore
+}
+
+// NewSQLRecipientResolver returns a RecipientResolver that looks group
+// members up in dbo.tb_emailGroupMember of a SQL Server database.
+func NewSQLRecipientResolver(db *sql.DB) RecipientResolver {
+	return &sqlRecipientResolver{db: newSQLStore(newResetRetryDB(db))}
+}
+
+func (r *sqlRecipientResolver) Resolve(ctx context.Context, addrs []string) ([]string, []string, error) {
+	codes := make([]string, 0)
+	for _, addr := range addrs {
+		if isGroupCode(addr) {
+			codes = append(codes, strings.TrimPrefix(addr, "@"))
+		}
+	}
+	if len(codes) == 0 {
+		return addrs, nil, nil
+	}
+
+	q, args := r.db.sb.Select("groupcode", "emailaddress").
+		From("dbo.tb_emailGroupMember").
+		Where(sq.Eq{"groupcode": codes}).
+		MustSql()
+
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query tb_emailGroupMember: %w", err)
+	}
+	defer rows.Close()
+
+	members := make(map[string][]string)
+	for rows.Next() {
+		var code, addr string
+		if err := rows.Scan(&code, &addr); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan tb_emailGroupMember: %w", err)
+		}
+		members[code] = append(members[code], addr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to iterate tb_emailGroupMember: %w", err)
+	}
+
+	resolved := make([]string, 0, len(addrs))
+	unresolved := make([]string, 0)
+	for _, addr := range addrs {
+		if !isGroupCode(addr) {
+			resolved = append(resolved, addr)
+			continue
+		}
+
+		m, ok := members[strings.TrimPrefix(addr, "@")]
+		if !ok {
+			unresolved = append(unresolved, addr)
+			continue
+		}
+		resolved = append(resolved, m...)
+	}
+
+	return resolved, unresolved, nil
+}
@@ -0,0 +1,189 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ConfigChange is a setting a reload changed, e.g. rules.R001.from. Old is
+// empty for an added setting, New for a removed one.
+type ConfigChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s %s→%s", c.Key, orNone(c.Old), orNone(c.New))
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+// redacted replaces the values of the secret looking settings in a diff.
+const redacted = "[REDACTED]"
+
+// secretKeys are the words marking a setting as secret.
+var secretKeys = []string{"password", "secret", "token", "key"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	for _, w := range secretKeys {
+		if strings.Contains(key, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfig returns the settings of old and new that differ, sorted by
+// key, the secret ones redacted. Both are flattened through their JSON
+// form, one key per leaf, e.g. rules.R001.cc_thresholds.0.above.
+func diffConfig(old, new any) ([]ConfigChange, error) {
+	before, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := flattenConfig(new)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := slices.Collect(maps.Keys(before))
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	changes := make([]ConfigChange, 0)
+	for _, k := range keys {
+		o, n := before[k], after[k]
+		if o == n {
+			continue
+		}
+		if isSecretKey(k) {
+			o, n = redactIfSet(o), redactIfSet(n)
+		}
+		changes = append(changes, ConfigChange{Key: k, Old: o, New: n})
+	}
+	return changes, nil
+}
+
+func redactIfSet(v string) string {
+	if v == "" {
+		return ""
+	}
+	return redacted
+}
+
+func flattenConfig(v any) (map[string]string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var tree any
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	flat := make(map[string]string)
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				walk(joinKey(prefix, k), child)
+			}
+		case []any:
+			for i, child := range v {
+				walk(joinKey(prefix, fmt.Sprint(i)), child)
+			}
+		case nil:
+		case string:
+			if v != "" {
+				flat[prefix] = v
+			}
+		default:
+			flat[prefix] = fmt.Sprint(v)
+		}
+	}
+	walk("", tree)
+	return flat, nil
+}
+
+func joinKey(prefix, k string) string {
+	if prefix == "" {
+		return k
+	}
+	return prefix + "." + k
+}
+
+// ReloadRules reads RULE_CONFIG_FILE again and applies its rules,
+// priorities, CC thresholds and send window from the next send on, and
+// returns what changed. The SMTP profiles are dialed from startup on, a
+// file changing them is refused.
+func (s *Service) ReloadRules(ctx context.Context) ([]ConfigChange, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "ReloadRules"),
+	)
+
+	if !s.mu.LockTimeout(ctx, s.lockTimeout) {
+		return nil, errSendBusy
+	}
+	defer s.mu.Unlock()
+
+	cfg, err := loadRuleConfigFile(s.ruleConfigPath)
+	if err != nil {
+		zlog.Error("failed to load rule config", zap.Error(err))
+		return nil, status.Errorf(codes.FailedPrecondition, "Rule config cannot be loaded: %s", err)
+	}
+
+	changes, err := diffConfig(s.ruleConfig, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		if strings.HasPrefix(c.Key, "smtp_profiles.") {
+			return nil, status.Error(codes.FailedPrecondition, "SMTP profiles changed, restart the service to apply them.")
+		}
+	}
+
+	profiles := make(map[string]bool, len(s.dialers))
+	for name := range s.dialers {
+		profiles[name] = true
+	}
+	rules, err := newRules(cfg, rule{
+		From:         s.rules.Load().defaults.From,
+		CCThresholds: cfg.CCThresholds,
+		footer:       s.rules.Load().defaults.footer,
+	}, profiles)
+	if err != nil {
+		zlog.Error("invalid rule config", zap.Error(err))
+		return nil, status.Errorf(codes.FailedPrecondition, "Invalid rule config: %s", err)
+	}
+
+	s.rules.Store(rules)
+	s.ruleConfig = cfg
+
+	diff := make([]string, 0, len(changes))
+	for _, c := range changes {
+		diff = append(diff, c.String())
+	}
+	zlog.Info("rule config reloaded", zap.Int("changes", len(changes)), zap.Strings("diff", diff))
+	return changes, nil
+}
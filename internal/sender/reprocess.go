@@ -0,0 +1,165 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// requeueFailedJob is the cursor key of RequeueFailed.
+const requeueFailedJob = "requeue-failed"
+
+// requeueFailedBatch is the number of messages requeued per checkpoint.
+const requeueFailedBatch = 500
+
+// RequeueFailed moves the StatusFailed messages that used all their
+// attempts back to the queue, in batches. Those failed on transient errors,
+// a stuck send or soft bounces, and may go through now. The ones the relay
+// or the service refused for good, with attempts left, stay failed.
+// The last requeued TWID is checkpointed with each batch, so a run
+// interrupted by a crash or a shutdown resumes where it stopped.
+//
+// The requeued messages move to the queue of today, the only one the send
+// jobs pick up. They keep their attempts, already at SEND_MAX_ATTEMPTS, so
+// each requeue gives them one more attempt rather than a fresh set.
+func (s *Service) RequeueFailed(ctx context.Context) (int64, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "RequeueFailed"),
+	)
+
+	day := capDay(time.Now())
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			zlog.Warn("requeue of failed messages interrupted", zap.Int64("requeued", total))
+			return total, err
+		}
+
+		n, err := s.store.RequeueFailed(ctx, requeueFailedJob, day, requeueFailedBatch, s.maxAttempts)
+		if err != nil {
+			zlog.Error("failed to requeue failed messages", zap.Int64("requeued", total), zap.Error(err))
+			return total, err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		zlog.Info("requeued failed messages", zap.Int64("batch", n), zap.Int64("requeued", total))
+	}
+
+	zlog.Info("requeue of failed messages done", zap.Int64("requeued", total))
+	return total, nil
+}
+
+func (db *sqlStore) RequeueFailed(ctx context.Context, job, day string, limit, maxAttempts int) (int64, error) {
+	var n int64
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		cursor, err := db.cursor(ctx, tx, job)
+		if err != nil {
+			return err
+		}
+
+		failed := sq.And{
+			sq.Eq{"rectype": StatusFailed},
+			sq.GtOrEq{"ISNULL(attempts, 0)": maxAttempts},
+		}
+
+		q, args := db.sb.Select("MAX(TWID)", "COUNT(*)").
+			FromSelect(
+				db.sb.Select("TWID").
+					Options(fmt.Sprintf("TOP %d", limit)).
+					From("dbo.tb_getEmailWiseSend").
+					Where(sq.And{failed, sq.Gt{"TWID": cursor}}).
+					OrderBy("TWID ASC"),
+				"batch",
+			).
+			MustSql()
+
+		var last sql.NullInt64
+		if err := tx.QueryRowContext(ctx, q, args...).Scan(&last, &n); err != nil {
+			return fmt.Errorf("failed to select failed messages: %w", err)
+		}
+		if n == 0 {
+			return db.clearCursor(ctx, tx, job)
+		}
+
+		q, args = db.sb.Update("dbo.tb_getEmailWiseSend").
+			Set("rectype", StatusAdd).
+			Set("txtdate", day).
+			Where(sq.And{
+				failed,
+				sq.Gt{"TWID": cursor},
+				sq.LtOrEq{"TWID": last.Int64},
+			}).
+			MustSql()
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			return fmt.Errorf("failed to requeue failed messages: %w", err)
+		}
+
+		return db.saveCursor(ctx, tx, job, last.Int64)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// cursor returns the last TWID processed by job, 0 when it has not started.
+func (db *sqlStore) cursor(ctx context.Context, tx *sql.Tx, job string) (int64, error) {
+	q, args := db.sb.Select("lasttwid").
+		From("dbo.tb_emailCursor").
+		Where(sq.Eq{"jobtype": job}).
+		MustSql()
+
+	var cursor int64
+	err := tx.QueryRowContext(ctx, q, args...).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cursor %s: %w", job, err)
+	}
+	return cursor, nil
+}
+
+func (db *sqlStore) saveCursor(ctx context.Context, tx *sql.Tx, job string, twid int64) error {
+	q, args := db.sb.Update("dbo.tb_emailCursor").
+		Set("lasttwid", twid).
+		Set("updatedat", sq.Expr("GETDATE()")).
+		Where(sq.Eq{"jobtype": job}).
+		MustSql()
+
+	res, err := tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return fmt.Errorf("failed to save cursor %s: %w", job, err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	q, args = db.sb.Insert("dbo.tb_emailCursor").
+		Columns("jobtype", "lasttwid", "updatedat").
+		Values(job, twid, sq.Expr("GETDATE()")).
+		MustSql()
+	if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("failed to save cursor %s: %w", job, err)
+	}
+	return nil
+}
+
+func (db *sqlStore) clearCursor(ctx context.Context, tx *sql.Tx, job string) error {
+	q, args := db.sb.Delete("dbo.tb_emailCursor").
+		Where(sq.Eq{"jobtype": job}).
+		MustSql()
+
+	if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("failed to clear cursor %s: %w", job, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package sender
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// SendResult summarizes a send run.
+type SendResult struct {
+	// Listed is the number of queued messages picked up by the run.
+	Listed int
+	// Sent is the number of messages accepted by the relay.
+	Sent int
+	// Failed is the number of messages the relay did not accept, taken out
+	// of the queue as StatusFailed.
+	Failed int
+	// Retried is the number of messages the relay did not accept for now,
+	// e.g. with a 4xx reply, requeued for a later run.
+	Retried int
+	// Skipped is the number of messages without recipient, or whose
+	// recipients are all invalid.
+	Skipped int
+	// Flagged is the number of messages taken out of the queue as
+	// StatusFlagged because they cannot be sent as they are.
+	Flagged int
+	// Quarantined is the number of messages taken out of the queue after
+	// causing a panic.
+	Quarantined int
+	// Duplicates is the number of messages taken out of the queue because
+	// their recipients got the same one recently.
+	Duplicates int
+	// Deferred is the number of messages left in the queue, or moved to
+	// the next day, because their rule is outside of its send window, a
+	// recipient reached the daily cap or the relay could not be used.
+	Deferred int
+	// FailedByRule counts the failed, flagged and quarantined messages of
+	// each rule.
+	FailedByRule map[string]int
+	// Outcomes tells what happened to each message picked up by the run.
+	Outcomes []MessageOutcome
+
+	// progress is called with each outcome as soon as it is known.
+	progress func(MessageOutcome)
+}
+
+// newSendResult returns the result of a run reporting its progress to the
+// func carried by ctx, if any.
+func newSendResult(ctx context.Context) *SendResult {
+	progress, _ := ctx.Value(progressKey{}).(func(MessageOutcome))
+	return &SendResult{progress: progress}
+}
+
+// Outcomes of a message in a send run.
+const (
+	OutcomeSent        = "sent"
+	OutcomeFailed      = "failed"
+	OutcomeRetried     = "retried"
+	OutcomeSkipped     = "skipped"
+	OutcomeFlagged     = "flagged"
+	OutcomeQuarantined = "quarantined"
+	OutcomeDuplicate   = "duplicate"
+	OutcomeDeferred    = "deferred"
+	// OutcomeNotQueued is a targeted message that was not waiting to be
+	// sent, e.g. because it already was.
+	OutcomeNotQueued = "not_queued"
+)
+
+// MessageOutcome is what a send run did with a message.
+type MessageOutcome struct {
+	TxnNo   string `json:"txn_no"`
+	RuleID  string `json:"rule_id,omitempty"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	// Recipients is the number of To, Cc and Bcc recipients of the message
+	// when its outcome was known.
+	Recipients int `json:"recipients,omitempty"`
+}
+
+func (r *SendResult) addOutcome(msg *Message, outcome, reason string) {
+	r.appendOutcome(MessageOutcome{
+		TxnNo:      msg.TxnNo,
+		RuleID:     msg.RuleID,
+		Outcome:    outcome,
+		Reason:     reason,
+		Recipients: len(recipientsOf(msg)),
+	})
+}
+
+func (r *SendResult) appendOutcome(o MessageOutcome) {
+	r.Outcomes = append(r.Outcomes, o)
+	if r.progress != nil {
+		r.progress(o)
+	}
+}
+
+// addFailure counts a failed, flagged or quarantined message of ruleID.
+func (r *SendResult) addFailure(ruleID string) {
+	if r.FailedByRule == nil {
+		r.FailedByRule = make(map[string]int)
+	}
+	r.FailedByRule[ruleID]++
+}
+
+// Fields returns r as log fields.
+func (r *SendResult) Fields() []zap.Field {
+	fields := []zap.Field{
+		zap.Int("listed", r.Listed),
+		zap.Int("sent", r.Sent),
+		zap.Int("failed", r.Failed),
+		zap.Int("retried", r.Retried),
+		zap.Int("skipped", r.Skipped),
+		zap.Int("flagged", r.Flagged),
+		zap.Int("quarantined", r.Quarantined),
+		zap.Int("duplicates", r.Duplicates),
+		zap.Int("deferred", r.Deferred),
+	}
+	if len(r.FailedByRule) > 0 {
+		fields = append(fields, zap.Any("failed_by_rule", r.FailedByRule))
+	}
+	return fields
+}
+
+type runIDKey struct{}
+
+// WithRunID returns a copy of ctx carrying runID, the correlation id logged
+// by everything a send run does.
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx making the send runs call progress
+// with the outcome of each message as soon as it is known, e.g. to stream
+// a long run. progress is called from the goroutine of the run and from
+// its send workers, never concurrently, so it must not block.
+func WithProgress(ctx context.Context, progress func(MessageOutcome)) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// RunID returns the run id carried by ctx, if any.
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
@@ -0,0 +1,311 @@
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	netmail "net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RuleConfig overrides the global settings for the messages of a rule.
+// Empty fields keep the global value.
+type RuleConfig struct {
+	From          string `json:"from"`
+	ReplyTo       string `json:"reply_to"`
+	SMTPProfile   string `json:"smtp_profile"`
+	SubjectPrefix string `json:"subject_prefix"`
+	FooterHTML    string `json:"footer_html"`
+	FooterText    string `json:"footer_text"`
+	// CCThresholds replaces the global thresholds when set.
+	CCThresholds []CCThreshold `json:"cc_thresholds"`
+	// Category is CategoryBulk for marketing mail, which should carry a
+	// ListUnsubscribe value such as "<mailto:unsubscribe@example.com>".
+	Category        string `json:"category"`
+	ListUnsubscribe string `json:"list_unsubscribe"`
+	// SendWindow replaces the global window when set, an empty one lets
+	// the rule send at any time.
+	SendWindow *SendWindow `json:"send_window"`
+}
+
+const (
+	CategoryTransactional = "transactional"
+	CategoryBulk          = "bulk"
+)
+
+// CCThreshold copies CC on the messages whose amount is above Above, e.g.
+// to let a supervisor see large transactions.
+type CCThreshold struct {
+	Above float64  `json:"above"`
+	CC    []string `json:"cc"`
+}
+
+// Priorities of a message, stored in the priority column. Anything else
+// counts as PriorityNormal.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorityRank orders the priorities, high first.
+var priorityRank = map[string]int{
+	PriorityHigh:   0,
+	PriorityNormal: 1,
+	PriorityLow:    2,
+}
+
+// normalizePriority returns the priority level of p.
+func normalizePriority(p string) string {
+	p = strings.ToLower(strings.TrimSpace(p))
+	if _, ok := priorityRank[p]; !ok {
+		return PriorityNormal
+	}
+	return p
+}
+
+// PriorityConfig is how the messages of a priority level are sent.
+type PriorityConfig struct {
+	// SMTPProfile routes the messages to a dedicated relay over the one of
+	// their rule.
+	SMTPProfile string `json:"smtp_profile"`
+	// Importance is written to the Importance and X-Priority headers:
+	// "high", "normal" or "low". Empty uses the level itself.
+	Importance string `json:"importance"`
+}
+
+// SMTPProfile is a relay the messages of a rule can be routed to.
+type SMTPProfile struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	// PasswordEnv names the environment variable holding the password so
+	// the file carries no secret.
+	PasswordEnv string `json:"password_env"`
+	MaxConns    int    `json:"max_conns"`
+}
+
+// RuleConfigFile is the content of RULE_CONFIG_FILE.
+type RuleConfigFile struct {
+	SMTPProfiles map[string]SMTPProfile `json:"smtp_profiles"`
+	Rules        map[string]RuleConfig  `json:"rules"`
+	// CCThresholds apply to the messages of every rule without its own.
+	CCThresholds []CCThreshold `json:"cc_thresholds"`
+	// Priorities configure the priority levels by name.
+	Priorities map[string]PriorityConfig `json:"priorities"`
+	// SendWindow applies to the messages of every rule without its own.
+	SendWindow *SendWindow `json:"send_window"`
+}
+
+// loadRuleConfigFile reads the rule config at path, an empty path yields an
+// empty config.
+func loadRuleConfigFile(path string) (*RuleConfigFile, error) {
+	cfg := new(RuleConfigFile)
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule config: %w", err)
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse rule config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// rule is the effective settings of a message: its rule config applied
+// over the global defaults.
+type rule struct {
+	From            string
+	ReplyTo         string
+	SMTPProfile     string
+	SubjectPrefix   string
+	CCThresholds    []CCThreshold
+	Category        string
+	ListUnsubscribe string
+	// Importance is the importance header value, none for normal.
+	Importance string
+	footer     *footer
+	// window is when the messages may be sent, nil for any time.
+	window *sendWindow
+}
+
+// thresholdCC returns the addresses to copy for a message of amount.
+func (r rule) thresholdCC(amount float64) []string {
+	cc := make([]string, 0)
+	for _, t := range r.CCThresholds {
+		if amount > t.Above {
+			cc = append(cc, t.CC...)
+		}
+	}
+	return cc
+}
+
+// rules resolves the settings of a message from its RuleID. It is built
+// once at startup so Send does a single map lookup per message.
+type rules struct {
+	defaults   rule
+	byID       map[string]rule
+	priorities map[string]PriorityConfig
+}
+
+// newRules applies the rule configs of cfg over defaults. Every rule must
+// route to a known SMTP profile, profiles lists them.
+func newRules(cfg *RuleConfigFile, defaults rule, profiles map[string]bool) (*rules, error) {
+	// Every message would be refused by the relay, or worse sent without
+	// a From.
+	if _, err := netmail.ParseAddress(defaults.From); err != nil {
+		return nil, fmt.Errorf("invalid default from %q, set MAIL_FROM to a mail address", defaults.From)
+	}
+	if cfg.SendWindow != nil {
+		w, err := cfg.SendWindow.parse()
+		if err != nil {
+			return nil, err
+		}
+		defaults.window = w
+	}
+
+	r := &rules{
+		defaults:   defaults,
+		byID:       make(map[string]rule, len(cfg.Rules)),
+		priorities: make(map[string]PriorityConfig, len(priorityRank)),
+	}
+
+	for level := range priorityRank {
+		r.priorities[level] = PriorityConfig{Importance: level}
+	}
+	for level, pc := range cfg.Priorities {
+		if _, ok := priorityRank[level]; !ok {
+			return nil, fmt.Errorf("unknown priority %q", level)
+		}
+		if pc.SMTPProfile != "" && !profiles[pc.SMTPProfile] {
+			return nil, fmt.Errorf("priority %q uses unknown smtp profile %q", level, pc.SMTPProfile)
+		}
+		if pc.Importance == "" {
+			pc.Importance = level
+		}
+		if _, ok := priorityRank[pc.Importance]; !ok {
+			return nil, fmt.Errorf("priority %q has unknown importance %q", level, pc.Importance)
+		}
+		r.priorities[level] = pc
+	}
+
+	for id, rc := range cfg.Rules {
+		eff := defaults
+		if rc.From != "" {
+			if _, err := netmail.ParseAddress(rc.From); err != nil {
+				return nil, fmt.Errorf("rule %q has invalid from %q", id, rc.From)
+			}
+			eff.From = rc.From
+		}
+		if rc.ReplyTo != "" {
+			eff.ReplyTo = rc.ReplyTo
+		}
+		if rc.SMTPProfile != "" {
+			if !profiles[rc.SMTPProfile] {
+				return nil, fmt.Errorf("rule %q uses unknown smtp profile %q", id, rc.SMTPProfile)
+			}
+			eff.SMTPProfile = rc.SMTPProfile
+		}
+		if rc.SubjectPrefix != "" {
+			eff.SubjectPrefix = rc.SubjectPrefix
+		}
+		if rc.CCThresholds != nil {
+			eff.CCThresholds = rc.CCThresholds
+		}
+		switch rc.Category {
+		case "", CategoryTransactional, CategoryBulk:
+			eff.Category = rc.Category
+		default:
+			return nil, fmt.Errorf("rule %q has unknown category %q", id, rc.Category)
+		}
+		eff.ListUnsubscribe = rc.ListUnsubscribe
+		if rc.SendWindow != nil {
+			w, err := rc.SendWindow.parse()
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", id, err)
+			}
+			eff.window = w
+		}
+
+		if rc.FooterHTML != "" || rc.FooterText != "" {
+			f, err := newFooter(rc.FooterHTML, rc.FooterText)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", id, err)
+			}
+			if f.html == nil {
+				f.html = defaults.footer.html
+			}
+			if f.text == nil {
+				f.text = defaults.footer.text
+			}
+			eff.footer = f
+		}
+
+		r.byID[id] = eff
+	}
+
+	return r, nil
+}
+
+// resolve returns the settings for the messages of ruleID.
+func (r *rules) resolve(ruleID string) rule {
+	if eff, ok := r.byID[ruleID]; ok {
+		return eff
+	}
+	return r.defaults
+}
+
+// resolvePriority returns the settings for the messages of ruleID sent at
+// priority: the priority level picks the relay, when it has its own, and the
+// importance.
+func (r *rules) resolvePriority(ruleID, priority string) rule {
+	eff := r.resolve(ruleID)
+	pc := r.priorities[normalizePriority(priority)]
+	if pc.SMTPProfile != "" {
+		eff.SMTPProfile = pc.SMTPProfile
+	}
+	if pc.Importance != PriorityNormal {
+		eff.Importance = pc.Importance
+	}
+	return eff
+}
+
+// label returns ruleID as a metric label. Only the configured rules get
+// their own label so the rule ids in the queue cannot blow up the series.
+func (r *rules) label(ruleID string) string {
+	if _, ok := r.byID[ruleID]; ok {
+		return ruleID
+	}
+	return "other"
+}
+
+// waiting returns the configured rules whose send window is closed at t but
+// opens later the same day, sorted, and whether the default window is.
+func (r *rules) waiting(t time.Time) ([]string, bool) {
+	waits := func(w *sendWindow) bool {
+		return !w.contains(t) && w.opensLater(t)
+	}
+
+	ids := make([]string, 0)
+	for _, id := range r.ids() {
+		if waits(r.byID[id].window) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, waits(r.defaults.window)
+}
+
+// ids returns the configured rule ids, sorted.
+func (r *rules) ids() []string {
+	ids := make([]string, 0, len(r.byID))
+	for id := range r.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,127 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RuleFilter restricts a send to the messages of some rules. The zero value
+// matches every rule.
+type RuleFilter struct {
+	// RuleIDs, when set, only matches these rules.
+	RuleIDs []string
+	// ExcludeRuleIDs never matches these rules.
+	ExcludeRuleIDs []string
+	// TxnNos, when set, only matches these messages, whatever their date.
+	TxnNos []string
+	// IncludeBCCOnly also matches the messages without To but with BCC
+	// recipients. The service sets it from Features.BCCOnly.
+	IncludeBCCOnly bool
+	// Limit caps the number of messages matched, DefaultBatchSize when 0.
+	// The service sets it from SEND_BATCH_SIZE.
+	Limit int
+}
+
+// RuleSchedule is a send job running every Interval for the rules matched
+// by Filter.
+type RuleSchedule struct {
+	Interval time.Duration
+	Filter   RuleFilter
+}
+
+// DefaultSendInterval is the interval of the send job when neither a
+// schedule nor SEND_INTERVAL is configured.
+const DefaultSendInterval = 10 * time.Second
+
+// ParseSendInterval parses SEND_INTERVAL, a Go duration such as "30s" or
+// "2m". An empty, malformed or non-positive value yields
+// DefaultSendInterval.
+func ParseSendInterval(v string) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil || d <= 0 {
+		return DefaultSendInterval
+	}
+	return d
+}
+
+// ParseRuleSchedules parses the SEND_SCHEDULES format, a semicolon separated
+// list of "<interval>:<rule>,<rule>" entries, e.g.
+//
+//	10s:R001,R002;5m:*
+//
+// The rule list "*" matches every rule not listed by another entry, so each
+// rule is picked up by exactly one job. An empty value yields a single job
+// running every defaultInterval for all rules.
+func ParseRuleSchedules(v string, defaultInterval time.Duration) ([]RuleSchedule, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return []RuleSchedule{{Interval: defaultInterval}}, nil
+	}
+
+	schedules := make([]RuleSchedule, 0)
+	listed := make([]string, 0)
+	catchAll := -1
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rawInterval, rawRules, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule %q: missing rule list", entry)
+		}
+
+		interval, err := time.ParseDuration(strings.TrimSpace(rawInterval))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", entry, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be positive", entry)
+		}
+
+		if strings.TrimSpace(rawRules) == "*" {
+			if catchAll >= 0 {
+				return nil, fmt.Errorf("invalid schedule %q: only one catch-all schedule is allowed", entry)
+			}
+			catchAll = len(schedules)
+			schedules = append(schedules, RuleSchedule{Interval: interval})
+			continue
+		}
+
+		rules := splitList(rawRules, ',')
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("invalid schedule %q: empty rule list", entry)
+		}
+		listed = append(listed, rules...)
+		schedules = append(schedules, RuleSchedule{
+			Interval: interval,
+			Filter:   RuleFilter{RuleIDs: rules},
+		})
+	}
+
+	if len(schedules) == 0 {
+		return []RuleSchedule{{Interval: defaultInterval}}, nil
+	}
+	if catchAll >= 0 {
+		schedules[catchAll].Filter.ExcludeRuleIDs = listed
+	}
+
+	return schedules, nil
+}
+
+// splitList splits v on sep, trimming spaces and dropping empty items.
+func splitList(v string, sep rune) []string {
+	items := strings.FieldsFunc(v, func(r rune) bool {
+		return r == sep
+	})
+
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,26 @@
+package sender
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSendInterval(t *testing.T) {
+	tests := []struct {
+		v    string
+		want time.Duration
+	}{
+		{v: "30s", want: 30 * time.Second},
+		{v: " 2m ", want: 2 * time.Minute},
+		{v: "", want: 10 * time.Second},
+		{v: "soon", want: 10 * time.Second},
+		{v: "60", want: 10 * time.Second},
+		{v: "-1m", want: 10 * time.Second},
+		{v: "0s", want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := ParseSendInterval(tt.v); got != tt.want {
+			t.Errorf("ParseSendInterval(%q) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package sender_test
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/mail.v2"
+
+	"sendingemail/internal/config"
+	"sendingemail/internal/sender"
+	"sendingemail/internal/sender/sendertest"
+)
+
+// fakeDialer accepts every mail but the ones to the addresses of refuse,
+// which fail with their error. With err set, it fails every send with it.
+type fakeDialer struct {
+	mu     sync.Mutex
+	refuse map[string]error
+	err    error
+	calls  int
+	to     []string
+}
+
+func (d *fakeDialer) DialAndSend(msgs ...*mail.Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls++
+	if d.err != nil {
+		return d.err
+	}
+	for _, m := range msgs {
+		for _, to := range m.GetHeader("To") {
+			if err := d.refuse[to]; err != nil {
+				return &mail.SendError{Cause: err}
+			}
+			d.to = append(d.to, to)
+		}
+	}
+	return nil
+}
+
+// recordingDialer keeps every mail it is given as written to the relay.
+type recordingDialer struct {
+	mu    sync.Mutex
+	mails []string
+}
+
+func (d *recordingDialer) DialAndSend(msgs ...*mail.Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, m := range msgs {
+		var b strings.Builder
+		if _, err := m.WriteTo(&b); err != nil {
+			return err
+		}
+		d.mails = append(d.mails, b.String())
+	}
+	return nil
+}
+
+// newService returns a service sending from store through a fakeDialer,
+// with the rule config ruleConfig when it is not empty.
+func newService(t *testing.T, store *sendertest.Store, ruleConfig string) (*sender.Service, *fakeDialer) {
+	t.Helper()
+
+	t.Setenv("SMTP_MAX_RETRIES", "0")
+	if ruleConfig != "" {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(ruleConfig), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("RULE_CONFIG_FILE", path)
+	}
+
+	cfg := &config.Config{
+		SMTP:     config.SMTP{Host: "localhost"},
+		MailFrom: "noreply@example.com",
+	}
+	svc, err := sender.NewService(context.Background(), cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	t.Cleanup(func() { svc.Close() })
+
+	d := &fakeDialer{refuse: make(map[string]error)}
+	svc.SetMessageStore(store)
+	svc.SetDialer("", d)
+	return svc, d
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// closedPromoConfig returns a rule config with the promo rule sending on
+// every day but today, closed for the rest of it.
+func closedPromoConfig() string {
+	days := make([]string, 0, 6)
+	for _, d := range []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} {
+		if d != strings.ToLower(time.Now().Weekday().String()[:3]) {
+			days = append(days, `"`+d+`"`)
+		}
+	}
+	return `{"rules": {"promo": {"send_window": {"days": [` + strings.Join(days, ",") + `]}}}}`
+}
+
+func TestSendRulesCounts(t *testing.T) {
+	t.Setenv("MAIL_MAX_CONTENT_BYTES", "64")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "ok", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "refused", Time: today(), ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "retried", Time: today(), ToAddresses: []string{"c@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "big", Time: today(), ToAddresses: []string{"d@example.com"}, Subject: "s", Content: strings.Repeat("x", 65)},
+		&sender.Message{TxnNo: "untemplated", Time: today(), ToAddresses: []string{"e@example.com"}, Template: "missing"},
+	)
+	svc, d := newService(t, store, "")
+	d.refuse["b@example.com"] = &textproto.Error{Code: 550, Msg: "no such user"}
+	d.refuse["c@example.com"] = &textproto.Error{Code: 451, Msg: "try again later"}
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err == nil {
+		t.Error("SendRules() error = nil, want the failed sends")
+	}
+
+	if res.Listed != 5 || res.Sent != 1 || res.Failed != 2 || res.Retried != 1 || res.Flagged != 1 {
+		t.Errorf("SendRules() listed, sent, failed, retried, flagged = %d, %d, %d, %d, %d, want 5, 1, 2, 1, 1",
+			res.Listed, res.Sent, res.Failed, res.Retried, res.Flagged)
+	}
+	store.AssertSent(t, "ok")
+	store.AssertFailed(t, "refused", "retried", "untemplated")
+
+	for txnNo, want := range map[string]string{
+		"refused":     sender.StatusFailed,
+		"retried":     sender.StatusAdd,
+		"big":         sender.StatusFlagged,
+		"untemplated": sender.StatusFailed,
+	} {
+		if got := store.Message(txnNo).Status; got != want {
+			t.Errorf("status of %s = %s, want %s", txnNo, got, want)
+		}
+	}
+}
+
+func TestSendRulesEndToEnd(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "order", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "Order 42", Content: "<p>Thank you</p>"},
+	)
+	svc, _ := newService(t, store, "")
+	d := &recordingDialer{}
+	svc.SetDialer("", d)
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Listed != 1 || res.Sent != 1 {
+		t.Errorf("SendRules() listed, sent = %d, %d, want 1, 1", res.Listed, res.Sent)
+	}
+	store.AssertSent(t, "order")
+
+	if len(d.mails) != 1 {
+		t.Fatalf("relay got %d mails, want 1", len(d.mails))
+	}
+	for _, want := range []string{
+		"From: noreply@example.com",
+		"To: a@example.com",
+		"Subject: Order 42",
+		"Content-Type: text/html",
+		"Thank you",
+	} {
+		if !strings.Contains(d.mails[0], want) {
+			t.Errorf("mail = %s, want %q in it", d.mails[0], want)
+		}
+	}
+
+	if got, want := store.EventTypes("order"), []string{sender.EventSending, sender.EventSent}; !slices.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSendRulesSendsAroundFailedMessage(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "first", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "second", Time: today(), ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "third", Time: today(), ToAddresses: []string{"c@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	d.refuse["b@example.com"] = &textproto.Error{Code: 550, Msg: "no such user"}
+
+	_, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err == nil || !strings.Contains(err.Error(), "failed to send 1 of 3 messages") {
+		t.Errorf("SendRules() error = %v, want 1 of 3 messages failed", err)
+	}
+	store.AssertSent(t, "first", "third")
+	store.AssertFailed(t, "second")
+
+	slices.Sort(d.to)
+	if want := []string{"a@example.com", "c@example.com"}; !slices.Equal(d.to, want) {
+		t.Errorf("sent to %v, want %v", d.to, want)
+	}
+}
+
+func TestSendRulesPostponesClosedWindow(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "promo", RuleID: "promo", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, _ := newService(t, store, closedPromoConfig())
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Deferred != 1 || res.Sent != 0 {
+		t.Errorf("SendRules() deferred, sent = %d, %d, want 1, 0", res.Deferred, res.Sent)
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	if m := store.Message("promo"); m.Status != sender.StatusAdd || m.Time != tomorrow {
+		t.Errorf("promo = %s on %s, want %s on %s", m.Status, m.Time, sender.StatusAdd, tomorrow)
+	}
+
+	res, err = svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Listed != 0 {
+		t.Errorf("second SendRules() listed %d, want the postponed message left out", res.Listed)
+	}
+}
+
+func TestSendRulesLeavesWaitingRulesOutOfBatch(t *testing.T) {
+	if now := time.Now(); now.Hour() == 23 && now.Minute() >= 58 {
+		t.Skip("the window of the test opens at 23:59")
+	}
+
+	t.Setenv("SEND_BATCH_SIZE", "1")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "promo", RuleID: "promo", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "otp", RuleID: "otp", Time: today(), ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, _ := newService(t, store, `{"rules": {"promo": {"send_window": {"start": "23:59"}}}}`)
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Listed != 1 || res.Deferred != 0 {
+		t.Errorf("SendRules() listed, deferred = %d, %d, want 1, 0", res.Listed, res.Deferred)
+	}
+	store.AssertSent(t, "otp")
+
+	if m := store.Message("promo"); m.Status != sender.StatusAdd || m.Time != today() {
+		t.Errorf("promo = %s on %s, want it queued for today", m.Status, m.Time)
+	}
+}
+
+func TestReapStuckLeavesUnreconciledAlone(t *testing.T) {
+	t.Setenv("SENDING_STUCK_AFTER", "1ns")
+	store := sendertest.NewStore(
+		&sender.Message{ID: 1, TxnNo: "stuck", Status: sender.StatusSending},
+		&sender.Message{ID: 2, TxnNo: "delivered", Status: sender.StatusSending},
+		&sender.Message{ID: 3, TxnNo: "queued"},
+	)
+	svc, _ := newService(t, store, "")
+
+	if err := store.MarkUnreconciled(context.Background(), store.Message("delivered")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := svc.ReapStuck(context.Background())
+	if err != nil {
+		t.Fatalf("ReapStuck() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("ReapStuck() = %d, want 1", n)
+	}
+
+	got := make([]string, 0, 3)
+	for _, txnNo := range []string{"stuck", "delivered", "queued"} {
+		got = append(got, store.Message(txnNo).Status)
+	}
+	want := []string{sender.StatusAdd, sender.StatusSending, sender.StatusAdd}
+	if !slices.Equal(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+}
+
+// flakyResolver fails the first lookup, then expands every group code to
+// the addresses of members.
+type flakyResolver struct {
+	failed  bool
+	members []string
+}
+
+func (r *flakyResolver) Resolve(_ context.Context, addrs []string) ([]string, []string, error) {
+	if !r.failed {
+		r.failed = true
+		return nil, nil, errors.New("connection reset by peer")
+	}
+
+	resolved := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "@") {
+			resolved = append(resolved, r.members...)
+			continue
+		}
+		resolved = append(resolved, addr)
+	}
+	return resolved, nil, nil
+}
+
+func TestSendRulesDoesNotResendAfterCrashBeforeStatusUpdate(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "order", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	// The process dies once the relay took the message: neither the status
+	// update nor its reconciliation record make it to the database.
+	crash := errors.New("connection lost")
+	store.FailNext("MarkSent", crash)
+	store.FailNext("MarkUnreconciled", crash)
+
+	svc.SendRules(context.Background(), sender.RuleFilter{})
+	if d.calls != 1 {
+		t.Fatalf("first run sent %d times, want 1", d.calls)
+	}
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("second SendRules() error = %v", err)
+	}
+	if res.Listed != 0 || d.calls != 1 {
+		t.Errorf("second run listed %d and sent %d times in all, want the claimed message left alone", res.Listed, d.calls)
+	}
+	if got := store.Message("order").Status; got != sender.StatusSending {
+		t.Errorf("status = %s, want it claimed as %s for ReapStuck", got, sender.StatusSending)
+	}
+}
+
+// fakeKillSwitch is engaged while engaged is set, unreadable with err set.
+type fakeKillSwitch struct {
+	engaged bool
+	err     error
+}
+
+func (k *fakeKillSwitch) Engaged(context.Context) (bool, error) {
+	return k.engaged, k.err
+}
+
+func TestSendRulesStopsOnKillSwitch(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "order", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	k := &fakeKillSwitch{engaged: true}
+	svc.SetKillSwitch(k)
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() with the switch on error = %v", err)
+	}
+	if res.Listed != 0 || d.calls != 0 {
+		t.Errorf("SendRules() with the switch on listed %d and sent %d, want nothing", res.Listed, d.calls)
+	}
+
+	k.engaged, k.err = false, errors.New("invalid object name")
+	if _, err := svc.SendRules(context.Background(), sender.RuleFilter{}); err == nil {
+		t.Error("SendRules() with an unreadable switch error = nil, want the read error")
+	}
+	if d.calls != 0 {
+		t.Errorf("SendRules() with an unreadable switch sent %d, want nothing", d.calls)
+	}
+
+	k.err = nil
+	res, err = svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() with the switch off error = %v", err)
+	}
+	if res.Sent != 1 {
+		t.Errorf("SendRules() with the switch off sent %d, want 1", res.Sent)
+	}
+	store.AssertSent(t, "order")
+}
+
+func TestSendRulesKeepsMessageQueuedWhenResolverFails(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "team", Time: today(), ToAddresses: []string{"@team"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	svc.SetRecipientResolver(&flakyResolver{members: []string{"a@example.com"}})
+
+	if _, err := svc.SendRules(context.Background(), sender.RuleFilter{}); err == nil {
+		t.Error("SendRules() error = nil, want the failed lookup")
+	}
+	if got := store.Message("team").Status; got != sender.StatusAdd {
+		t.Fatalf("status after the failed lookup = %s, want %s", got, sender.StatusAdd)
+	}
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("second SendRules() error = %v", err)
+	}
+	if res.Sent != 1 {
+		t.Errorf("second SendRules() sent %d, want 1", res.Sent)
+	}
+	if !slices.Equal(d.to, []string{"a@example.com"}) {
+		t.Errorf("sent to %v, want [a@example.com]", d.to)
+	}
+}
+
+// panickingResolver panics on the group code @boom, the way a bug hit by
+// one malformed message would, and leaves the other addresses alone.
+type panickingResolver struct{}
+
+func (panickingResolver) Resolve(_ context.Context, addrs []string) ([]string, []string, error) {
+	if slices.Contains(addrs, "@boom") {
+		panic("malformed group")
+	}
+	return addrs, nil, nil
+}
+
+func TestSendRulesQuarantinesPanickingMessage(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "boom", Time: today(), ToAddresses: []string{"@boom"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "ok", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, _ := newService(t, store, "")
+	svc.SetRecipientResolver(panickingResolver{})
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Quarantined != 1 || res.Sent != 1 {
+		t.Errorf("SendRules() quarantined, sent = %d, %d, want 1, 1", res.Quarantined, res.Sent)
+	}
+	store.AssertSent(t, "ok")
+
+	m := store.Message("boom")
+	if m.Status != sender.StatusQuarantined || !strings.Contains(m.Comment, "malformed group") {
+		t.Errorf("boom = %s with comment %q, want %s with the panic", m.Status, m.Comment, sender.StatusQuarantined)
+	}
+}
+
+func TestSendRulesRequeuesOnRelayError(t *testing.T) {
+	t.Setenv("SEND_CONCURRENCY", "1")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "a", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "b", Time: today(), ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "c", Time: today(), ToAddresses: []string{"c@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	d.err = &sender.RelayError{Err: &textproto.Error{Code: 535, Msg: "authentication failed"}}
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err == nil {
+		t.Error("SendRules() error = nil, want the relay error")
+	}
+	if res.Failed != 0 || res.Deferred != 3 {
+		t.Errorf("SendRules() failed, deferred = %d, %d, want 0, 3", res.Failed, res.Deferred)
+	}
+	if d.calls != 1 {
+		t.Errorf("relay called %d times, want the run stopped after the first failure", d.calls)
+	}
+	for _, txnNo := range []string{"a", "b", "c"} {
+		if got := store.Message(txnNo).Status; got != sender.StatusAdd {
+			t.Errorf("status of %s = %s, want %s", txnNo, got, sender.StatusAdd)
+		}
+	}
+}
+
+func TestSendRulesFailsAfterMaxAttempts(t *testing.T) {
+	t.Setenv("SEND_MAX_ATTEMPTS", "2")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "greylisted", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+	d.refuse["a@example.com"] = &textproto.Error{Code: 451, Msg: "try again later"}
+
+	res, _ := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if res.Retried != 1 || res.Failed != 0 {
+		t.Errorf("first SendRules() retried, failed = %d, %d, want 1, 0", res.Retried, res.Failed)
+	}
+	if got := store.Message("greylisted").Status; got != sender.StatusAdd {
+		t.Fatalf("status after the first attempt = %s, want %s", got, sender.StatusAdd)
+	}
+
+	res, _ = svc.SendRules(context.Background(), sender.RuleFilter{})
+	if res.Retried != 0 || res.Failed != 1 {
+		t.Errorf("second SendRules() retried, failed = %d, %d, want 0, 1", res.Retried, res.Failed)
+	}
+	if got := store.Message("greylisted").Status; got != sender.StatusFailed {
+		t.Errorf("status after the last attempt = %s, want %s", got, sender.StatusFailed)
+	}
+}
+
+func TestHandleBounceRetriesBouncedRecipient(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "bounced", Time: yesterday, Status: sender.StatusSent, ToAddresses: []string{"a@example.com", "b@example.com"}, BCCAddresses: []string{"c@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+
+	class, err := svc.HandleBounce(context.Background(), sender.Bounce{TxnNo: "bounced", Recipient: "mallory@example.com", Status: "4.2.2"})
+	if err != nil || class != sender.BounceSoft {
+		t.Fatalf("HandleBounce() = %s, %v, want %s", class, err, sender.BounceSoft)
+	}
+	if got := store.Message("bounced").Status; got != sender.StatusSent {
+		t.Fatalf("status after the bounce of another address = %s, want %s", got, sender.StatusSent)
+	}
+
+	if _, err := svc.HandleBounce(context.Background(), sender.Bounce{TxnNo: "bounced", Recipient: "B@example.com", Status: "4.2.2"}); err != nil {
+		t.Fatalf("HandleBounce() error = %v", err)
+	}
+	if m := store.Message("bounced"); m.Status != sender.StatusAdd || m.Time != today() {
+		t.Fatalf("bounced = %s on %s, want %s on %s", m.Status, m.Time, sender.StatusAdd, today())
+	}
+
+	res, err := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if err != nil {
+		t.Fatalf("SendRules() error = %v", err)
+	}
+	if res.Sent != 1 {
+		t.Errorf("SendRules() sent %d, want the bounced message sent again", res.Sent)
+	}
+	if !slices.Equal(d.to, []string{"B@example.com"}) {
+		t.Errorf("sent again to %v, want the bounced recipient alone", d.to)
+	}
+}
+
+func TestRequeueFailedMovesToToday(t *testing.T) {
+	t.Setenv("SEND_MAX_ATTEMPTS", "2")
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "exhausted", Time: yesterday, Status: sender.StatusFailed, Attempts: 2, ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "refused", Time: yesterday, Status: sender.StatusFailed, Attempts: 1, ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, d := newService(t, store, "")
+
+	n, err := svc.RequeueFailed(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("RequeueFailed() = %d, %v, want 1", n, err)
+	}
+	if m := store.Message("exhausted"); m.Status != sender.StatusAdd || m.Time != today() {
+		t.Errorf("exhausted = %s on %s, want %s on %s", m.Status, m.Time, sender.StatusAdd, today())
+	}
+	if got := store.Message("refused").Status; got != sender.StatusFailed {
+		t.Errorf("status of refused = %s, want %s", got, sender.StatusFailed)
+	}
+
+	// The requeued message has one more attempt, not a fresh set.
+	d.refuse["a@example.com"] = &textproto.Error{Code: 451, Msg: "try again later"}
+	res, _ := svc.SendRules(context.Background(), sender.RuleFilter{})
+	if res.Listed != 1 || res.Failed != 1 || res.Retried != 0 {
+		t.Errorf("SendRules() listed, failed, retried = %d, %d, %d, want 1, 1, 0", res.Listed, res.Failed, res.Retried)
+	}
+}
+
+func TestReloadRulesWhileHandlingBounces(t *testing.T) {
+	amount := 100.0
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "bounced", Time: today(), Status: sender.StatusSent, ToAddresses: []string{"a@example.com"}, Amount: &amount, Subject: "s", Content: "hello"},
+	)
+	svc, _ := newService(t, store, `{"rules": {"promo": {"from": "promo@example.com"}}}`)
+
+	// Run with -race: the reload swaps the rules the bounces read.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			if _, err := svc.ReloadRules(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for range 10 {
+		if _, err := svc.HandleBounce(context.Background(), sender.Bounce{TxnNo: "bounced", Recipient: "nobody@example.com", Status: "4.2.2"}); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestNextBatchLeavesClosedWindowOut(t *testing.T) {
+	store := sendertest.NewStore(
+		&sender.Message{TxnNo: "promo", RuleID: "promo", Time: today(), ToAddresses: []string{"a@example.com"}, Subject: "s", Content: "hello"},
+		&sender.Message{TxnNo: "otp", RuleID: "otp", Time: today(), ToAddresses: []string{"b@example.com"}, Subject: "s", Content: "hello"},
+	)
+	svc, _ := newService(t, store, closedPromoConfig())
+
+	msgs, err := svc.NextBatch(context.Background())
+	if err != nil {
+		t.Fatalf("NextBatch() error = %v", err)
+	}
+	got := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		got = append(got, m.TxnNo)
+	}
+	if !slices.Equal(got, []string{"otp"}) {
+		t.Errorf("NextBatch() = %v, want [otp]", got)
+	}
+}
+
+func TestValidateTemplatesRendersMessageTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"welcome.subject":     "Welcome {{.Data.name}}",
+		"welcome.txt":         "Hello {{.Data.name}}, order {{.TxnNo}}",
+		"welcome.sample.json": `{"name": "Ann"}`,
+		"receipt.subject":     "Receipt {{.Data.order.id}}",
+		"receipt.txt":         "Thank you",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("MAIL_TEMPLATE_DIR", dir)
+
+	svc, _ := newService(t, sendertest.NewStore(), "")
+	broken := svc.ValidateTemplates(context.Background())
+	if len(broken) != 1 || broken[0].Name != "template receipt" {
+		t.Fatalf("ValidateTemplates() = %+v, want only template receipt", broken)
+	}
+}
@@ -0,0 +1,633 @@
+// Package sendertest provides an in-memory sender.MessageStore to test the
+// sender without a database.
+package sendertest
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sendingemail/internal/sender"
+)
+
+// Store is an in-memory sender.MessageStore. It is seeded with Add and
+// records the status changes made by the service. The zero value is ready
+// to use.
+type Store struct {
+	mu sync.Mutex
+
+	messages  []*sender.Message
+	nextID    int64
+	attempts  map[int64]int
+	sendingAt map[int64]time.Time
+	errs      map[string][]error
+	cursors   map[string]int64
+	events    []sender.Event
+
+	populated   int
+	sent        []string
+	requeued    []string
+	failed      []string
+	quarantined []string
+	// unreconciled holds the comment of the messages delivered but not
+	// marked as sent, by ID.
+	unreconciled map[int64]string
+}
+
+var _ sender.MessageStore = (*Store)(nil)
+
+// NewStore returns a Store seeded with msgs.
+func NewStore(msgs ...*sender.Message) *Store {
+	s := new(Store)
+	s.Add(msgs...)
+	return s
+}
+
+// Add queues copies of msgs. Messages without ID get the next one,
+// messages without status are queued as sender.StatusAdd and the attempts
+// of each message start at its Attempts.
+func (s *Store) Add(msgs ...*sender.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range msgs {
+		m := clone(msg)
+		if m.ID == 0 {
+			s.nextID++
+			m.ID = s.nextID
+		} else if m.ID > s.nextID {
+			s.nextID = m.ID
+		}
+		if m.Status == "" {
+			m.Status = sender.StatusAdd
+		}
+		if m.Attempts > 0 {
+			if s.attempts == nil {
+				s.attempts = make(map[int64]int)
+				s.sendingAt = make(map[int64]time.Time)
+			}
+			s.attempts[m.ID] = m.Attempts
+		}
+		s.messages = append(s.messages, m)
+	}
+}
+
+// FailNext makes the next calls to method, e.g. "Populate", return errs in
+// order before behaving normally again.
+func (s *Store) FailNext(method string, errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errs == nil {
+		s.errs = make(map[string][]error)
+	}
+	s.errs[method] = append(s.errs[method], errs...)
+}
+
+// fail pops the next error queued for method. The caller holds mu.
+func (s *Store) fail(method string) error {
+	errs := s.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	s.errs[method] = errs[1:]
+	return errs[0]
+}
+
+func (s *Store) Populate(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.populated++
+	return s.fail("Populate")
+}
+
+// List returns the queued messages matched by filter, high priority first.
+// Like the SQL store, it only picks the messages of today unless filter
+// targets txnNos.
+func (s *Store) List(_ context.Context, filter sender.RuleFilter) ([]*sender.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("List"); err != nil {
+		return nil, err
+	}
+
+	queued := slices.Clone(s.messages)
+	slices.SortStableFunc(queued, func(a, b *sender.Message) int {
+		return priorityRank(a.Priority) - priorityRank(b.Priority)
+	})
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = sender.DefaultBatchSize
+	}
+
+	today := time.Now().Format("2006-01-02")
+	msgs := make([]*sender.Message, 0)
+	for _, m := range queued {
+		if len(msgs) == limit {
+			break
+		}
+		if m.Status != sender.StatusAdd {
+			continue
+		}
+		if len(filter.TxnNos) == 0 && m.Time != today {
+			continue
+		}
+		if len(m.ToAddresses) == 0 && !(filter.IncludeBCCOnly && len(m.BCCAddresses) > 0) {
+			continue
+		}
+		if len(filter.TxnNos) > 0 && !slices.Contains(filter.TxnNos, m.TxnNo) {
+			continue
+		}
+		if len(filter.RuleIDs) > 0 && !slices.Contains(filter.RuleIDs, m.RuleID) {
+			continue
+		}
+		if slices.Contains(filter.ExcludeRuleIDs, m.RuleID) {
+			continue
+		}
+		msgs = append(msgs, clone(m))
+	}
+	return msgs, nil
+}
+
+func (s *Store) Get(_ context.Context, txnNo string) (*sender.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Get"); err != nil {
+		return nil, err
+	}
+	if m := s.find(txnNo); m != nil {
+		return clone(m), nil
+	}
+	return nil, nil
+}
+
+func (s *Store) MissingTxnNos(_ context.Context, txnNos []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MissingTxnNos"); err != nil {
+		return nil, err
+	}
+
+	missing := make([]string, 0)
+	for _, txnNo := range txnNos {
+		if s.find(txnNo) == nil {
+			missing = append(missing, txnNo)
+		}
+	}
+	return missing, nil
+}
+
+func (s *Store) MarkSending(_ context.Context, msgs []*sender.Message) ([]*sender.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkSending"); err != nil {
+		return nil, err
+	}
+
+	if s.attempts == nil {
+		s.attempts = make(map[int64]int)
+		s.sendingAt = make(map[int64]time.Time)
+	}
+	claimed := make([]*sender.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusAdd {
+			m.Status = sender.StatusSending
+			s.attempts[m.ID]++
+			s.sendingAt[m.ID] = time.Now()
+			msg.Attempts = s.attempts[m.ID]
+			claimed = append(claimed, msg)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *Store) Requeue(_ context.Context, msgs []*sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Requeue"); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusSending {
+			m.Status = sender.StatusAdd
+			m.Comment = msg.Comment
+			s.requeued = append(s.requeued, m.TxnNo)
+		}
+	}
+	return nil
+}
+
+func (s *Store) Postpone(_ context.Context, msgs []*sender.Message, day string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Postpone"); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusAdd {
+			m.Time = day
+		}
+	}
+	return nil
+}
+
+func (s *Store) MarkFailed(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkFailed"); err != nil {
+		return err
+	}
+
+	if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusSending {
+		m.Status = sender.StatusFailed
+		m.Comment = msg.Comment
+		s.failed = append(s.failed, m.TxnNo)
+	}
+	return nil
+}
+
+// MarkUnreconciled records msg, ReapStuck then leaves it alone.
+func (s *Store) MarkUnreconciled(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkUnreconciled"); err != nil {
+		return err
+	}
+
+	if s.unreconciled == nil {
+		s.unreconciled = make(map[int64]string)
+	}
+	s.unreconciled[msg.ID] = msg.Comment
+	return nil
+}
+
+// Enqueue queues a copy of msg, like Add.
+func (s *Store) Enqueue(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	err := s.fail("Enqueue")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.Add(msg)
+	return nil
+}
+
+func (s *Store) MarkInvalid(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkInvalid"); err != nil {
+		return err
+	}
+
+	if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusAdd {
+		m.Status = sender.StatusFailed
+		m.Comment = msg.Comment
+		s.failed = append(s.failed, m.TxnNo)
+	}
+	return nil
+}
+
+func (s *Store) MarkSent(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkSent"); err != nil {
+		return err
+	}
+	s.markSent(msg)
+	return nil
+}
+
+func (s *Store) MarkSentBatch(_ context.Context, msgs []*sender.Message) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkSentBatch"); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, msg := range msgs {
+		if s.markSent(msg) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// markSent moves msg to sender.StatusSent. The caller holds mu.
+func (s *Store) markSent(msg *sender.Message) bool {
+	m := s.byID(msg.ID)
+	if m == nil {
+		return false
+	}
+
+	now := time.Now()
+	m.Status = sender.StatusSent
+	m.SentAt = &now
+	s.sent = append(s.sent, m.TxnNo)
+	return true
+}
+
+func (s *Store) Quarantine(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Quarantine"); err != nil {
+		return err
+	}
+
+	if m := s.byID(msg.ID); m != nil {
+		m.Status = sender.StatusQuarantined
+		m.Comment = msg.Comment
+		s.quarantined = append(s.quarantined, m.TxnNo)
+	}
+	return nil
+}
+
+func (s *Store) MarkFlagged(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkFlagged"); err != nil {
+		return err
+	}
+
+	if m := s.byID(msg.ID); m != nil && m.Status == sender.StatusAdd {
+		m.Status = sender.StatusFlagged
+		m.Comment = msg.Comment
+	}
+	return nil
+}
+
+func (s *Store) MarkDuplicate(_ context.Context, msg *sender.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("MarkDuplicate"); err != nil {
+		return err
+	}
+
+	if m := s.byID(msg.ID); m != nil {
+		m.Status = sender.StatusDuplicate
+		m.Comment = msg.Comment
+	}
+	return nil
+}
+
+func (s *Store) RetryBounced(_ context.Context, txnNo, recipient, day string, maxAttempts int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("RetryBounced"); err != nil {
+		return false, err
+	}
+
+	m := s.find(txnNo)
+	if m == nil || m.Status != sender.StatusSent {
+		return false, nil
+	}
+	if s.attempts[m.ID] >= maxAttempts {
+		m.Status = sender.StatusFailed
+		return false, nil
+	}
+	m.Status = sender.StatusAdd
+	m.Time = day
+	m.ToAddresses = []string{recipient}
+	m.BCCAddresses = nil
+	m.Amount = nil
+	return true, nil
+}
+
+func (s *Store) RequeueFailed(_ context.Context, job, day string, limit, maxAttempts int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("RequeueFailed"); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	cursor := s.cursors[job]
+	for _, m := range s.messages {
+		if n == int64(limit) {
+			break
+		}
+		if m.Status != sender.StatusFailed || m.ID <= cursor || s.attempts[m.ID] < maxAttempts {
+			continue
+		}
+		m.Status = sender.StatusAdd
+		m.Time = day
+		cursor = max(cursor, m.ID)
+		n++
+	}
+
+	if n == 0 {
+		delete(s.cursors, job)
+		return 0, nil
+	}
+	if s.cursors == nil {
+		s.cursors = make(map[string]int64)
+	}
+	s.cursors[job] = cursor
+	return n, nil
+}
+
+func (s *Store) RecordEvents(_ context.Context, events []sender.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("RecordEvents"); err != nil {
+		return err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *Store) Events(_ context.Context, txnNo string) ([]sender.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Events"); err != nil {
+		return nil, err
+	}
+
+	events := make([]sender.Event, 0)
+	for _, e := range s.events {
+		if e.TxnNo == txnNo {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// EventTypes returns the types of the events recorded for txnNo, in
+// order.
+func (s *Store) EventTypes(txnNo string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	types := make([]string, 0)
+	for _, e := range s.events {
+		if e.TxnNo == txnNo {
+			types = append(types, e.Type)
+		}
+	}
+	return types
+}
+
+// Cursor returns the checkpoint of job, 0 when there is none.
+func (s *Store) Cursor(job string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cursors[job]
+}
+
+func (s *Store) ReapStuck(_ context.Context, stuckBefore time.Time, maxAttempts int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("ReapStuck"); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, m := range s.messages {
+		if m.Status != sender.StatusSending || !s.sendingAt[m.ID].Before(stuckBefore) {
+			continue
+		}
+		if _, ok := s.unreconciled[m.ID]; ok {
+			continue
+		}
+		if s.attempts[m.ID] >= maxAttempts {
+			m.Status = sender.StatusFailed
+		} else {
+			m.Status = sender.StatusAdd
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Message returns a copy of the latest message with txnNo, nil when there
+// is none.
+func (s *Store) Message(txnNo string) *sender.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m := s.find(txnNo); m != nil {
+		return clone(m)
+	}
+	return nil
+}
+
+// Populated returns how many times Populate was called.
+func (s *Store) Populated() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.populated
+}
+
+// Sent returns the txnNos marked as sent, in order.
+func (s *Store) Sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.sent)
+}
+
+// Failed returns the txnNos requeued or failed after a failed send, then
+// the quarantined ones, in order.
+func (s *Store) Failed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Concat(s.requeued, s.failed, s.quarantined)
+}
+
+// AssertSent fails t unless exactly txnNos were marked as sent, in any
+// order.
+func (s *Store) AssertSent(t testing.TB, txnNos ...string) {
+	t.Helper()
+	assertSet(t, "sent", s.Sent(), txnNos)
+}
+
+// AssertFailed fails t unless exactly txnNos were requeued, failed or
+// quarantined, in any order.
+func (s *Store) AssertFailed(t testing.TB, txnNos ...string) {
+	t.Helper()
+	assertSet(t, "failed", s.Failed(), txnNos)
+}
+
+func assertSet(t testing.TB, name string, got, want []string) {
+	t.Helper()
+
+	got, want = slices.Clone(got), slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("%s messages = %v, want %v", name, got, want)
+	}
+}
+
+// find returns the latest message with txnNo. The caller holds mu.
+func (s *Store) find(txnNo string) *sender.Message {
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].TxnNo == txnNo {
+			return s.messages[i]
+		}
+	}
+	return nil
+}
+
+// byID returns the message with id. The caller holds mu.
+func (s *Store) byID(id int64) *sender.Message {
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// priorityRank orders the priorities like the database store does.
+func priorityRank(p string) int {
+	switch strings.ToLower(strings.TrimSpace(p)) {
+	case sender.PriorityHigh:
+		return 0
+	case sender.PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// clone copies msg so the service and the store never share a message.
+func clone(msg *sender.Message) *sender.Message {
+	m := *msg
+	m.ToAddresses = slices.Clone(msg.ToAddresses)
+	m.CCAddresses = slices.Clone(msg.CCAddresses)
+	m.BCCAddresses = slices.Clone(msg.BCCAddresses)
+	m.Attachments = slices.Clone(msg.Attachments)
+	return &m
+}
@@ -0,0 +1,490 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// smtpDialer connects to the relay the way mail.Dialer does, but sends over
+// its own client so the envelope commands can carry ESMTP parameters.
+type smtpDialer struct {
+	*mail.Dialer
+	smtpOptions
+
+	// greeting is what the relay told the last successful dial.
+	greeting atomic.Pointer[RelayGreeting]
+}
+
+// smtpOptions are the settings of the sender on top of mail.Dialer.
+type smtpOptions struct {
+	// dsnNotify is the DSN NOTIFY parameter added to every RCPT command,
+	// e.g. "FAILURE,DELAY", when the relay advertises DSN. Empty disables
+	// it.
+	dsnNotify string
+	// allowInsecureAuth lets the credentials go over a connection that is
+	// not encrypted.
+	allowInsecureAuth bool
+}
+
+// errInsecureAuth is returned by Dial instead of sending the credentials in
+// clear text.
+var errInsecureAuth = errors.New("refusing to send SMTP credentials over an unencrypted connection, enable STARTTLS or implicit TLS on the relay or set SMTP_ALLOW_INSECURE_AUTH")
+
+func newSMTPDialer(host string, port int, username, password string, opts smtpOptions) *smtpDialer {
+	return &smtpDialer{
+		Dialer:      mail.NewDialer(host, port, username, password),
+		smtpOptions: opts,
+	}
+}
+
+// RelayError is a failure to connect to the relay, upgrade the connection
+// to TLS or authenticate, e.g. rejected credentials. It says nothing about
+// the message being sent: the run requeues its messages and stops. A Dialer
+// returns it for such failures.
+type RelayError struct {
+	Err error
+}
+
+func (e *RelayError) Error() string { return e.Err.Error() }
+
+func (e *RelayError) Unwrap() error { return e.Err }
+
+// isRelayError reports whether err is a *RelayError, the relay and not the
+// message failing.
+func isRelayError(err error) bool {
+	// mail.SendError does not unwrap.
+	var se *mail.SendError
+	if errors.As(err, &se) {
+		err = se.Cause
+	}
+
+	var re *RelayError
+	return errors.As(err, &re)
+}
+
+// Dial connects, upgrades to TLS and authenticates to the relay. Its
+// failures are returned as a *RelayError.
+func (d *smtpDialer) Dial() (mail.SendCloser, error) {
+	c, err := d.dial()
+	if err != nil {
+		return nil, &RelayError{Err: err}
+	}
+	return c, nil
+}
+
+func (d *smtpDialer) dial() (*smtpConn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(d.Host, strconv.Itoa(d.Port)), d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.SSL {
+		conn = tls.Client(conn, d.tlsConfig())
+	}
+	// The greeting is read before any STARTTLS, in clear text or over the
+	// implicit TLS.
+	bc := &bannerConn{Conn: conn}
+	conn = bc
+
+	c, err := smtp.NewClient(conn, d.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	if d.LocalName != "" {
+		if err := c.Hello(d.LocalName); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if !d.SSL && d.StartTLSPolicy != mail.NoStartTLS {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && d.StartTLSPolicy == mail.MandatoryStartTLS {
+			c.Close()
+			return nil, mail.StartTLSUnsupportedError{Policy: d.StartTLSPolicy}
+		}
+		if ok {
+			if err := c.StartTLS(d.tlsConfig()); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if auth := d.auth(c); auth != nil {
+		if _, encrypted := c.TLSConnectionState(); !encrypted && !d.allowInsecureAuth {
+			c.Close()
+			return nil, errInsecureAuth
+		}
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	d.greeting.Store(&RelayGreeting{
+		Banner:     bc.banner(),
+		Extensions: advertisedExtensions(c),
+		At:         time.Now(),
+	})
+
+	dsn, _ := c.Extension("DSN")
+	return &smtpConn{
+		client:    c,
+		conn:      conn,
+		timeout:   d.Timeout,
+		dsnNotify: d.dsnNotifyIf(dsn),
+		caps:      readCapabilities(c),
+	}, nil
+}
+
+// smtpCapabilities are the ESMTP extensions the relay advertised after
+// EHLO that change how messages are sent.
+type smtpCapabilities struct {
+	// size is the largest message the relay accepts in bytes, 0 when it
+	// does not say.
+	size int64
+	// pipelining lets the envelope commands go out without waiting for
+	// each reply.
+	pipelining bool
+	// eightBitMIME lets the body carry 8-bit data.
+	eightBitMIME bool
+	// smtpUTF8 lets the addresses carry UTF-8.
+	smtpUTF8 bool
+}
+
+func readCapabilities(c *smtp.Client) smtpCapabilities {
+	var caps smtpCapabilities
+	if ok, param := c.Extension("SIZE"); ok {
+		caps.size, _ = strconv.ParseInt(strings.TrimSpace(param), 10, 64)
+	}
+	caps.pipelining, _ = c.Extension("PIPELINING")
+	caps.eightBitMIME, _ = c.Extension("8BITMIME")
+	caps.smtpUTF8, _ = c.Extension("SMTPUTF8")
+	return caps
+}
+
+// messageTooLargeError is returned by Send for a message over the SIZE the
+// relay advertised, before anything is sent.
+type messageTooLargeError struct {
+	size  int64
+	limit int64
+}
+
+func (e *messageTooLargeError) Error() string {
+	return fmt.Sprintf("message too large: %d bytes, over the %d bytes the relay accepts", e.size, e.limit)
+}
+
+// dsnNotifyIf returns the NOTIFY parameter to send, none when the relay
+// does not support DSN.
+func (d *smtpDialer) dsnNotifyIf(supported bool) string {
+	if !supported {
+		return ""
+	}
+	return d.dsnNotify
+}
+
+// auth picks the mechanism the same way mail.Dialer does.
+func (d *smtpDialer) auth(c *smtp.Client) smtp.Auth {
+	if d.Auth != nil {
+		return d.Auth
+	}
+	if d.Username == "" {
+		return nil
+	}
+
+	ok, auths := c.Extension("AUTH")
+	switch {
+	case !ok:
+		return nil
+	case strings.Contains(auths, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(d.Username, d.Password)
+	case strings.Contains(auths, "LOGIN") && !strings.Contains(auths, "PLAIN"):
+		return &loginAuth{username: d.Username, password: d.Password, host: d.Host}
+	case d.allowInsecureAuth:
+		return insecureAuth{smtp.PlainAuth("", d.Username, d.Password, d.Host)}
+	default:
+		return smtp.PlainAuth("", d.Username, d.Password, d.Host)
+	}
+}
+
+// insecureAuth lets an smtp.Auth that requires TLS, like PLAIN, run over a
+// connection without it.
+type insecureAuth struct {
+	smtp.Auth
+}
+
+func (a insecureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+func (d *smtpDialer) tlsConfig() *tls.Config {
+	if d.TLSConfig == nil {
+		return &tls.Config{ServerName: d.Host}
+	}
+	return d.TLSConfig
+}
+
+// smtpConn is an authenticated connection to the relay.
+type smtpConn struct {
+	client    *smtp.Client
+	conn      net.Conn
+	timeout   time.Duration
+	dsnNotify string
+	caps      smtpCapabilities
+}
+
+func (c *smtpConn) Send(from string, to []string, msg io.WriterTo) error {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	// The message is written out first so its size is known up front.
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	size := int64(buf.Len())
+	if c.caps.size > 0 && size > c.caps.size {
+		return &messageTooLargeError{size: size, limit: c.caps.size}
+	}
+
+	if err := c.envelope(from, to, size); err != nil {
+		return err
+	}
+
+	w, err := c.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// staleConnError is a connection found closed by the first command of a
+// send, before anything went over it, e.g. dropped by the relay while it
+// sat idle in the pool.
+type staleConnError struct {
+	err error
+}
+
+func (e *staleConnError) Error() string { return e.err.Error() }
+
+func (e *staleConnError) Unwrap() error { return e.err }
+
+// isStaleConn reports whether err is a *staleConnError, the message can go
+// over another connection without being delivered twice.
+func isStaleConn(err error) bool {
+	// mail.SendError does not unwrap.
+	var se *mail.SendError
+	if errors.As(err, &se) {
+		err = se.Cause
+	}
+
+	var sce *staleConnError
+	return errors.As(err, &sce)
+}
+
+// firstCmdErr returns err, the failure of the first command of a send, as
+// a *staleConnError when the connection was already closed.
+func firstCmdErr(err error) error {
+	if errors.Is(err, io.EOF) || isConnReset(err) {
+		return &staleConnError{err: err}
+	}
+	return err
+}
+
+// envelope issues the MAIL and RCPT commands, all at once when the relay
+// supports pipelining.
+func (c *smtpConn) envelope(from string, to []string, size int64) error {
+	cmds := make([]smtpCmd, 0, len(to)+1)
+	cmds = append(cmds, smtpCmd{code: 250, line: c.mailLine(from, size)})
+	for _, addr := range to {
+		cmds = append(cmds, smtpCmd{code: 25, line: c.rcptLine(addr)})
+	}
+	for _, cmd := range cmds {
+		if strings.ContainsAny(cmd.line, "\r\n") {
+			return errors.New("smtp: A line must not contain CR or LF")
+		}
+	}
+
+	if !c.caps.pipelining {
+		for i, cmd := range cmds {
+			id, err := c.client.Text.Cmd("%s", cmd.line)
+			if err == nil {
+				err = c.readResponse(id, cmd.code)
+			}
+			if err != nil && i == 0 {
+				return firstCmdErr(err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ids := make([]uint, 0, len(cmds))
+	for i, cmd := range cmds {
+		id, err := c.client.Text.Cmd("%s", cmd.line)
+		if err != nil && i == 0 {
+			return firstCmdErr(err)
+		}
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	// Every reply is read to keep the connection in sync, the first
+	// error is the one reported.
+	var first error
+	for i, id := range ids {
+		if err := c.readResponse(id, cmds[i].code); err != nil && first == nil {
+			first = err
+			if i == 0 {
+				first = firstCmdErr(err)
+			}
+		}
+	}
+	return first
+}
+
+// smtpCmd is a command line and the reply code it expects.
+type smtpCmd struct {
+	code int
+	line string
+}
+
+func (c *smtpConn) readResponse(id uint, code int) error {
+	c.client.Text.StartResponse(id)
+	defer c.client.Text.EndResponse(id)
+
+	_, _, err := c.client.Text.ReadResponse(code)
+	return err
+}
+
+// mailLine returns the MAIL command for from, declaring the size of the
+// message and its body type to the relays that support it.
+func (c *smtpConn) mailLine(from string, size int64) string {
+	line := fmt.Sprintf("MAIL FROM:<%s>", from)
+	if c.caps.eightBitMIME {
+		line += " BODY=8BITMIME"
+	}
+	if c.caps.smtpUTF8 {
+		line += " SMTPUTF8"
+	}
+	if c.caps.size > 0 {
+		line += fmt.Sprintf(" SIZE=%d", size)
+	}
+	return line
+}
+
+// rcptLine returns the RCPT command for addr, asking for delivery status
+// notifications about the original recipient when DSN is enabled.
+func (c *smtpConn) rcptLine(addr string) string {
+	if c.dsnNotify == "" {
+		return fmt.Sprintf("RCPT TO:<%s>", addr)
+	}
+	return fmt.Sprintf("RCPT TO:<%s> NOTIFY=%s ORCPT=rfc822;%s", addr, c.dsnNotify, xtext(addr))
+}
+
+// Noop checks that the relay still holds the connection.
+func (c *smtpConn) Noop() error {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.client.Noop()
+}
+
+func (c *smtpConn) Close() error {
+	return c.client.Quit()
+}
+
+// isTransientSMTP reports whether sending may succeed if tried again: the
+// relay could not be reached or answered with a 4xx reply. 5xx replies,
+// like an unknown recipient or rejected credentials, are permanent.
+func isTransientSMTP(err error) bool {
+	// mail.SendError does not unwrap.
+	var se *mail.SendError
+	if errors.As(err, &se) {
+		err = se.Cause
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		isConnReset(err)
+}
+
+// xtext encodes s as an RFC 3461 xtext, as the ORCPT parameter requires.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp lacks.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if server.Name != a.host {
+		return "", nil, errors.New("smtp: wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch {
+	case bytes.Equal(fromServer, []byte("Username:")):
+		return []byte(a.username), nil
+	case bytes.Equal(fromServer, []byte("Password:")):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("smtp: unexpected server challenge: %s", fromServer)
+	}
+}
@@ -0,0 +1,28 @@
+package sender
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+func TestDialFailureIsRelayError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	d := newSMTPDialer("127.0.0.1", port, "", "", smtpOptions{})
+	d.Timeout = time.Second
+	_, err = d.Dial()
+	if !isRelayError(err) {
+		t.Errorf("Dial() error = %v, want a *RelayError", err)
+	}
+	if !isRelayError(&mail.SendError{Cause: err}) {
+		t.Errorf("isRelayError() = false for a wrapped %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// MarkSending claims msgs right before they are handed to the relay: in a
+// single transaction, the ones still in StatusAdd are locked and moved to
+// StatusSending, counting the attempt, so two runs never send the same
+// message. A crash while sending leaves them claimed for ReapStuck to
+// find, instead of queued for the next run.
+func (db *sqlStore) MarkSending(ctx context.Context, msgs []*Message) ([]*Message, error) {
+	byID := make(map[int64]*Message, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.ID] = msg
+	}
+
+	claimed := make([]*Message, 0, len(msgs))
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		q, args := db.sb.Select("TWID", "ISNULL(attempts, 0)").
+			From("dbo.tb_getEmailWiseSend WITH (UPDLOCK, ROWLOCK)").
+			Where(sq.Eq{
+				"TWID":    messageIDs(msgs),
+				"rectype": StatusAdd,
+			}).
+			MustSql()
+
+		rows, err := tx.QueryContext(ctx, q, args...)
+		if err != nil {
+			return fmt.Errorf("failed to claim messages: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var attempts int
+			if err := rows.Scan(&id, &attempts); err != nil {
+				return fmt.Errorf("failed to scan claimed messages: %w", err)
+			}
+			if msg, ok := byID[id]; ok {
+				msg.Attempts = attempts + 1
+				claimed = append(claimed, msg)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to scan claimed messages: %w", err)
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		q, args = db.sb.Update("dbo.tb_getEmailWiseSend").
+			Set("rectype", StatusSending).
+			Set("sendingat", sq.Expr("GETDATE()")).
+			Set("attempts", sq.Expr("ISNULL(attempts, 0) + 1")).
+			Where(sq.Eq{"TWID": messageIDs(claimed)}).
+			MustSql()
+
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			return fmt.Errorf("failed to mark messages as sending: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// Requeue moves msgs back to StatusAdd after a failed send, writing the
+// reason of the failure to their comments. Each message takes 3 parameters,
+// so they are requeued by writeChunk.
+func (db *sqlStore) Requeue(ctx context.Context, msgs []*Message) error {
+	for chunk := range slices.Chunk(msgs, writeChunk) {
+		comments := sq.Case("TWID")
+		for _, msg := range chunk {
+			comments = comments.When(sq.Expr("?", msg.ID), sq.Expr("?", msg.Comment))
+		}
+
+		q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+			Set("rectype", StatusAdd).
+			Set("comments", comments.Else("comments")).
+			Where(sq.Eq{
+				"TWID":    messageIDs(chunk),
+				"rectype": StatusSending,
+			}).
+			MustSql()
+
+		if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+			return fmt.Errorf("failed to requeue messages: %w", err)
+		}
+	}
+	return nil
+}
+
+// Postpone sets the txtdate of msgs to day, the send jobs pick them up on
+// that day.
+func (db *sqlStore) Postpone(ctx context.Context, msgs []*Message, day string) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("txtdate", day).
+		Where(sq.Eq{
+			"TWID":    messageIDs(msgs),
+			"rectype": StatusAdd,
+		}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to postpone messages: %w", err)
+	}
+	return nil
+}
+
+// MarkFailed moves msg to StatusFailed after a send the relay refused for
+// good, writing the reason to its comments.
+func (db *sqlStore) MarkFailed(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusFailed).
+		Set("comments", msg.Comment).
+		Where(sq.Eq{
+			"TWID":    msg.ID,
+			"rectype": StatusSending,
+		}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to mark message as failed: %w", err)
+	}
+	return nil
+}
+
+// MarkInvalid moves the queued msg to StatusFailed when it cannot be sent
+// as it is, writing the reason to its comments.
+func (db *sqlStore) MarkInvalid(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusFailed).
+		Set("comments", msg.Comment).
+		Where(sq.Eq{
+			"TWID":    msg.ID,
+			"rectype": StatusAdd,
+		}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to mark message as invalid: %w", err)
+	}
+	return nil
+}
+
+// MarkFlagged moves msg from StatusAdd to StatusFlagged with its comment.
+func (db *sqlStore) MarkFlagged(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusFlagged).
+		Set("comments", msg.Comment).
+		Where(sq.Eq{
+			"TWID":    msg.ID,
+			"rectype": StatusAdd,
+		}).
+		MustSql()
+
+	if _, err := db.ExecContext(idempotent(ctx), q, args...); err != nil {
+		return fmt.Errorf("failed to mark message as flagged: %w", err)
+	}
+	return nil
+}
+
+// markSent records msgs as sent. In batch mode a single statement covers
+// them all; should it fail or miss rows, the messages fall back to one
+// pd_updategetemailwisesend call each.
+func (s *Service) markSent(ctx context.Context, zlog *zap.Logger, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if s.features.BatchStatusUpdate {
+		n, err := s.store.MarkSentBatch(ctx, msgs)
+		if err == nil && n == int64(len(msgs)) {
+			return nil
+		}
+		zlog.Warn("batch status update incomplete, falling back to per-message updates",
+			zap.Int64("updated", n),
+			zap.Int("expected", len(msgs)),
+			zap.Error(err),
+		)
+	}
+
+	var errs []error
+	for _, msg := range msgs {
+		if err := s.store.MarkSent(ctx, msg); err != nil {
+			s.markUnreconciled(ctx, zlog, msg, err)
+			errs = append(errs, fmt.Errorf("txnno %s: %w", msg.TxnNo, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// markUnreconciled records msg, delivered but not marked as sent, for an
+// operator to reconcile. ReapStuck leaves it alone, requeuing it would
+// deliver it twice.
+func (s *Service) markUnreconciled(ctx context.Context, zlog *zap.Logger, msg *Message, err error) {
+	zlog.Error("message delivered but not marked as sent, reconcile it by hand",
+		zap.String("txnno", msg.TxnNo),
+		zap.Error(err),
+	)
+	senderUnreconciled.Inc()
+
+	msg.Comment = fmt.Sprintf("delivered, status update failed: %s", err)
+	if err := s.store.MarkUnreconciled(ctx, msg); err != nil {
+		zlog.Error("failed to record unreconciled message",
+			zap.String("txnno", msg.TxnNo),
+			zap.Error(err),
+		)
+	}
+}
+
+// MarkUnreconciled inserts msg into dbo.tb_emailReconcile with its
+// comment.
+func (db *sqlStore) MarkUnreconciled(ctx context.Context, msg *Message) error {
+	q, args := db.sb.Insert("dbo.tb_emailReconcile").
+		Columns("twid", "txnno", "reason", "createdat").
+		Values(msg.ID, msg.TxnNo, msg.Comment, sq.Expr("GETDATE()")).
+		MustSql()
+
+	if _, err := db.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("failed to insert tb_emailReconcile: %w", err)
+	}
+	return nil
+}
+
+// MarkSent marks msg as sent with pd_updategetemailwisesend, then calls the
+// after-send procedure, in a transaction rolled back when either fails.
+func (db *sqlStore) MarkSent(ctx context.Context, msg *Message) error {
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "EXEC dbo.pd_updategetemailwisesend @txnno", sql.Named("txnno", msg.TxnNo)); err != nil {
+			return fmt.Errorf("failed to mark message as sent: %w", err)
+		}
+		if db.afterSend == "" {
+			return nil
+		}
+		return db.callAfterSend(ctx, tx, msg)
+	})
+}
+
+// MarkSentBatch marks msgs as sent in one round-trip and returns how many
+// rows it updated. With an after-send procedure, nothing is kept unless
+// every message was updated, so the per-message fallback does not call it
+// twice.
+func (db *sqlStore) MarkSentBatch(ctx context.Context, msgs []*Message) (int64, error) {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusSent).
+		Set("senddatetime", sq.Expr("GETDATE()")).
+		Where(sq.Eq{"TWID": messageIDs(msgs)}).
+		MustSql()
+
+	if db.afterSend == "" {
+		res, err := db.ExecContext(ctx, q, args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to mark messages as sent: %w", err)
+		}
+		return res.RowsAffected()
+	}
+
+	var n int64
+	errIncomplete := errors.New("batch status update incomplete")
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, q, args...)
+		if err != nil {
+			return fmt.Errorf("failed to mark messages as sent: %w", err)
+		}
+		if n, _ = res.RowsAffected(); n != int64(len(msgs)) {
+			return errIncomplete
+		}
+
+		for _, msg := range msgs {
+			if err := db.callAfterSend(ctx, tx, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errIncomplete) {
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// callAfterSend runs the after-send procedure for msg.
+func (db *sqlStore) callAfterSend(ctx context.Context, tx execer, msg *Message) error {
+	if _, err := tx.ExecContext(ctx, "EXEC "+db.afterSend+" @txnno", sql.Named("txnno", msg.TxnNo)); err != nil {
+		return fmt.Errorf("failed to execute after-send procedure %s: %w", db.afterSend, err)
+	}
+	return nil
+}
+
+func messageIDs(msgs []*Message) []int64 {
+	ids := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// ReapStuck finds the messages stranded in StatusSending for longer than
+// the configured threshold, e.g. because the process crashed mid-send, and
+// requeues them, or fails them once they used all their attempts. It
+// returns how many messages were recovered.
+func (s *Service) ReapStuck(ctx context.Context) (int64, error) {
+	zlog := s.zlog.With(
+		zap.String("service", "sender"),
+		zap.String("method", "ReapStuck"),
+	)
+
+	n, err := s.store.ReapStuck(ctx, time.Now().Add(-s.stuckAfter), s.maxAttempts)
+	if err != nil {
+		zlog.Error("failed to reap stuck messages", zap.Error(err))
+		return 0, err
+	}
+
+	if n > 0 {
+		zlog.Warn("recovered messages stuck in sending", zap.Int64("count", n))
+	}
+	return n, nil
+}
+
+func (db *sqlStore) ReapStuck(ctx context.Context, stuckBefore time.Time, maxAttempts int) (int64, error) {
+	q, args := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", sq.Expr("CASE WHEN ISNULL(attempts, 0) >= ? THEN ? ELSE ? END", maxAttempts, StatusFailed, StatusAdd)).
+		Where(sq.And{
+			sq.Eq{"rectype": StatusSending},
+			sq.Lt{"sendingat": stuckBefore},
+			sq.Expr("NOT EXISTS (SELECT 1 FROM dbo.tb_emailReconcile r WHERE r.twid = dbo.tb_getEmailWiseSend.TWID)"),
+		}).
+		MustSql()
+
+	res, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reap stuck messages: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// RetryBounced narrows the recipients to the bounced one so that the others,
+// who got the message, do not get it twice. The amount goes too, the CC
+// recipients of its thresholds got it as well.
+func (db *sqlStore) RetryBounced(ctx context.Context, txnNo, recipient, day string, maxAttempts int) (bool, error) {
+	b := db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusAdd).
+		Set("txtdate", day).
+		Set("toaddress", recipient).
+		Set("bccaddress", nil)
+	if db.features.Amounts {
+		b = b.Set("amount", nil)
+	}
+	q, args := b.
+		Where(sq.And{
+			sq.Eq{"Txnno": txnNo, "rectype": StatusSent},
+			sq.Lt{"ISNULL(attempts, 0)": maxAttempts},
+		}).
+		MustSql()
+
+	res, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to requeue bounced message: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+
+	q, args = db.sb.Update("dbo.tb_getEmailWiseSend").
+		Set("rectype", StatusFailed).
+		Where(sq.Eq{"Txnno": txnNo, "rectype": StatusSent}).
+		MustSql()
+
+	if _, err := db.ExecContext(ctx, q, args...); err != nil {
+		return false, fmt.Errorf("failed to fail bounced message: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,245 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// execQuerier is the subset of *sql.DB used by the sender.
+type execQuerier interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// execer runs statements, on the database or in a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// MessageStore is the queue the service sends from, tb_getEmailWiseSend in
+// production.
+type MessageStore interface {
+	// Populate fills the queue from the business tables.
+	Populate(ctx context.Context) error
+	// List returns up to a batch of messages waiting to be sent, matched
+	// by filter, oldest first.
+	List(ctx context.Context, filter RuleFilter) ([]*Message, error)
+	// Get returns the latest message with txnNo, whatever its status, or
+	// nil when there is none.
+	Get(ctx context.Context, txnNo string) (*Message, error)
+	// MissingTxnNos returns the txnNos without any message.
+	MissingTxnNos(ctx context.Context, txnNos []string) ([]string, error)
+
+	// MarkSending claims msgs: it moves the ones still in StatusAdd to
+	// StatusSending, counting the attempt in their Attempts, and returns
+	// them. The others were claimed by another run in the meantime.
+	MarkSending(ctx context.Context, msgs []*Message) ([]*Message, error)
+	// Requeue moves msgs back from StatusSending to StatusAdd, keeping
+	// their comment.
+	Requeue(ctx context.Context, msgs []*Message) error
+	// Postpone moves msgs, still in StatusAdd, to the queue of day, as
+	// "2006-01-02".
+	Postpone(ctx context.Context, msgs []*Message, day string) error
+	// MarkFailed moves msg from StatusSending to StatusFailed with its
+	// comment.
+	MarkFailed(ctx context.Context, msg *Message) error
+	// MarkInvalid moves msg from StatusAdd to StatusFailed with its
+	// comment, without an attempt.
+	MarkInvalid(ctx context.Context, msg *Message) error
+	// MarkFlagged moves msg from StatusAdd to StatusFlagged with its
+	// comment, without an attempt.
+	MarkFlagged(ctx context.Context, msg *Message) error
+	// MarkSent records msg as sent.
+	MarkSent(ctx context.Context, msg *Message) error
+	// MarkSentBatch records msgs as sent at once and returns how many of
+	// them it updated.
+	MarkSentBatch(ctx context.Context, msgs []*Message) (int64, error)
+	// Quarantine moves msg to StatusQuarantined with its comment.
+	Quarantine(ctx context.Context, msg *Message) error
+	// MarkDuplicate moves msg to StatusDuplicate with its comment.
+	MarkDuplicate(ctx context.Context, msg *Message) error
+	// RetryBounced requeues the sent message with txnNo for day after a
+	// soft bounce of recipient, to recipient alone, or fails it once it has
+	// maxAttempts attempts. It reports whether the message was requeued.
+	RetryBounced(ctx context.Context, txnNo, recipient, day string, maxAttempts int) (bool, error)
+	// RequeueFailed requeues up to limit StatusFailed messages with at
+	// least maxAttempts attempts past the cursor of job for day, keeping
+	// their attempts, and moves the cursor after them, at once. It returns
+	// how many messages it requeued, none once the job is done, which also
+	// clears the cursor.
+	RequeueFailed(ctx context.Context, job, day string, limit, maxAttempts int) (int64, error)
+	// RecordEvents appends events to the timelines of their messages.
+	RecordEvents(ctx context.Context, events []Event) error
+	// Events returns the timeline of the messages with txnNo, oldest
+	// first.
+	Events(ctx context.Context, txnNo string) ([]Event, error)
+	// ReapStuck requeues the messages in StatusSending since before
+	// stuckBefore, or fails the ones with maxAttempts attempts, and returns
+	// how many it moved.
+	ReapStuck(ctx context.Context, stuckBefore time.Time, maxAttempts int) (int64, error)
+	// MarkUnreconciled records msg, delivered but not marked as sent, for
+	// ReapStuck to leave alone.
+	MarkUnreconciled(ctx context.Context, msg *Message) error
+	// Enqueue inserts msg into the queue.
+	Enqueue(ctx context.Context, msg *Message) error
+}
+
+// sqlStore is the MessageStore of the SQL Server database. Its queries are
+// T-SQL, its statement builder writes @p bind variables.
+type sqlStore struct {
+	execQuerier
+	sb sq.StatementBuilderType
+
+	// afterSend is a procedure called with @txnno for every sent message,
+	// in the transaction marking it sent, e.g. to flag the business record
+	// as notified. Empty disables it.
+	afterSend string
+
+	// predicates narrow the messages List picks, from SEND_SELECT.
+	predicates []sq.Sqlizer
+
+	// features tell the optional columns and tables the schema has.
+	features Features
+}
+
+func newSQLStore(db execQuerier) *sqlStore {
+	return &sqlStore{
+		execQuerier: db,
+		sb:          sq.StatementBuilder.PlaceholderFormat(sq.AtP),
+	}
+}
+
+// procedureName matches the names accepted for SP_AFTER_SEND, which is
+// written into the statement as is.
+var procedureName = regexp.MustCompile(`^[A-Za-z_][\w.\[\]]*$`)
+
+// setAfterSend sets the procedure called for every sent message.
+func (db *sqlStore) setAfterSend(name string) error {
+	if name != "" && !procedureName.MatchString(name) {
+		return fmt.Errorf("invalid SP_AFTER_SEND procedure name %q", name)
+	}
+	db.afterSend = name
+	return nil
+}
+
+// writeChunk is the most rows written by one statement, well under the 2100
+// parameters of SQL Server with up to 4 parameters per row.
+const writeChunk = 500
+
+// inTx runs fn in a transaction, committed when fn succeeds.
+func (db *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resetRetryDB retries a call once when it failed because the pooled
+// connection was reset, e.g. by a firewall dropping long-idle connections.
+// The retry runs on a freshly acquired connection. A reset may come after
+// the server ran the statement, so only queries, transaction starts and
+// the statements run with an idempotent context are retried.
+type resetRetryDB struct {
+	db *sql.DB
+}
+
+type idempotentKey struct{}
+
+// idempotent returns ctx marking the statements run with it as safe to run
+// twice, e.g. an update to a status guarded by the status it moves from.
+func idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	ok, _ := ctx.Value(idempotentKey{}).(bool)
+	return ok
+}
+
+func newResetRetryDB(db *sql.DB) *resetRetryDB {
+	return &resetRetryDB{db: db}
+}
+
+func (r *resetRetryDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if isConnReset(err) && isIdempotent(ctx) && ctx.Err() == nil {
+		return r.db.ExecContext(ctx, query, args...)
+	}
+	return res, err
+}
+
+func (r *resetRetryDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	tx, err := r.db.BeginTx(ctx, opts)
+	if isConnReset(err) && ctx.Err() == nil {
+		return r.db.BeginTx(ctx, opts)
+	}
+	return tx, err
+}
+
+func (r *resetRetryDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if isConnReset(err) && ctx.Err() == nil {
+		return r.db.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+// isConnReset reports whether err means the connection to the database was
+// broken rather than the statement itself failing.
+func isConnReset(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	// go-mssqldb does not always wrap the underlying network error.
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "broken pipe")
+}
+
+// SQL Server errors worth retrying a statement for.
+const (
+	sqlErrDeadlock    = 1205
+	sqlErrLockTimeout = 1222
+)
+
+// isContention reports whether err means the statement lost to another
+// writer or timed out, so running it again may succeed.
+func isContention(err error) bool {
+	var sqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlErr) {
+		switch sqlErr.SQLErrorNumber() {
+		case sqlErrDeadlock, sqlErrLockTimeout:
+			return true
+		}
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,274 @@
+package sender
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingDB records the statements run on it, which all succeed.
+type recordingDB struct {
+	queries []string
+	args    [][]any
+}
+
+func (db *recordingDB) ExecContext(_ context.Context, query string, args ...any) (sql.Result, error) {
+	db.queries = append(db.queries, query)
+	db.args = append(db.args, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (db *recordingDB) QueryContext(context.Context, string, ...any) (*sql.Rows, error) {
+	return nil, errors.New("query not supported")
+}
+
+func (db *recordingDB) BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error) {
+	return nil, errors.New("transaction not supported")
+}
+
+// maxParams is the most parameters SQL Server takes in one statement.
+const maxParams = 2100
+
+func TestRequeueChunks(t *testing.T) {
+	db := &recordingDB{}
+	msgs := make([]*Message, 1200)
+	for i := range msgs {
+		msgs[i] = &Message{ID: int64(i + 1), Comment: "retry"}
+	}
+
+	if err := newSQLStore(db).Requeue(context.Background(), msgs); err != nil {
+		t.Fatalf("Requeue() error = %v", err)
+	}
+	if len(db.queries) != 3 {
+		t.Fatalf("Requeue() ran %d statements, want 3", len(db.queries))
+	}
+	for i, args := range db.args {
+		if len(args) > maxParams {
+			t.Errorf("statement %d has %d parameters, want at most %d", i, len(args), maxParams)
+		}
+	}
+}
+
+func TestRecordEventsChunks(t *testing.T) {
+	db := &recordingDB{}
+	events := make([]Event, 1001)
+	for i := range events {
+		events[i] = Event{TxnNo: "txn", Type: EventSent, At: time.Now()}
+	}
+
+	if err := newSQLStore(db).RecordEvents(context.Background(), events); err != nil {
+		t.Fatalf("RecordEvents() error = %v", err)
+	}
+	if len(db.queries) != 3 {
+		t.Fatalf("RecordEvents() ran %d statements, want 3", len(db.queries))
+	}
+	for i, args := range db.args {
+		if len(args) > maxParams {
+			t.Errorf("statement %d has %d parameters, want at most %d", i, len(args), maxParams)
+		}
+	}
+}
+
+func TestReapStuckConditions(t *testing.T) {
+	db := &recordingDB{}
+	if _, err := newSQLStore(db).ReapStuck(context.Background(), time.Now(), 3); err != nil {
+		t.Fatalf("ReapStuck() error = %v", err)
+	}
+	if len(db.queries) != 1 {
+		t.Fatalf("ReapStuck() ran %d statements, want 1", len(db.queries))
+	}
+	q := db.queries[0]
+	if !strings.Contains(q, "sendingat < ") {
+		t.Errorf("ReapStuck() query = %s, want only the messages stuck since before stuckBefore", q)
+	}
+	if !strings.Contains(q, "r.twid = dbo.tb_getEmailWiseSend.TWID") {
+		t.Errorf("ReapStuck() query = %s, want the reconciled rows matched on the outer TWID", q)
+	}
+}
+
+// flakyConnector opens connections whose statements are reset fails times,
+// then succeed.
+type flakyConnector struct {
+	mu    sync.Mutex
+	fails int
+	execs int
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) {
+	return &flakyConn{c: c}, nil
+}
+
+func (c *flakyConnector) Driver() driver.Driver {
+	return nil
+}
+
+type flakyConn struct {
+	c *flakyConnector
+}
+
+func (cn *flakyConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	c := cn.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.execs++
+	if c.fails > 0 {
+		c.fails--
+		return nil, syscall.ECONNRESET
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (cn *flakyConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (cn *flakyConn) Close() error {
+	return nil
+}
+
+func (cn *flakyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transaction not supported")
+}
+
+func TestResetRetryDBRetriesOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		wantExecs int
+		wantErr   bool
+	}{
+		{
+			name:      "idempotent statement",
+			ctx:       idempotent(context.Background()),
+			wantExecs: 2,
+		},
+		{
+			name:      "other statement",
+			ctx:       context.Background(),
+			wantExecs: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &flakyConnector{fails: 1}
+			db := sql.OpenDB(c)
+			defer db.Close()
+
+			_, err := newResetRetryDB(db).ExecContext(tt.ctx, "UPDATE t SET status = 'SENT'")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ExecContext() error = %v, want error %v", err, tt.wantErr)
+			}
+			if c.execs != tt.wantExecs {
+				t.Errorf("statement ran %d times, want %d", c.execs, tt.wantExecs)
+			}
+		})
+	}
+}
+
+// txConnector opens connections counting the transactions committed and
+// rolled back. The statements containing failOn fail.
+type txConnector struct {
+	failOn string
+
+	mu        sync.Mutex
+	commits   int
+	rollbacks int
+}
+
+func (c *txConnector) Connect(context.Context) (driver.Conn, error) {
+	return &txConn{c: c}, nil
+}
+
+func (c *txConnector) Driver() driver.Driver {
+	return nil
+}
+
+type txConn struct {
+	c *txConnector
+}
+
+func (cn *txConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if cn.c.failOn != "" && strings.Contains(query, cn.c.failOn) {
+		return nil, errors.New("procedure failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (cn *txConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (cn *txConn) Close() error {
+	return nil
+}
+
+func (cn *txConn) Begin() (driver.Tx, error) {
+	return cn, nil
+}
+
+func (cn *txConn) Commit() error {
+	cn.c.mu.Lock()
+	defer cn.c.mu.Unlock()
+
+	cn.c.commits++
+	return nil
+}
+
+func (cn *txConn) Rollback() error {
+	cn.c.mu.Lock()
+	defer cn.c.mu.Unlock()
+
+	cn.c.rollbacks++
+	return nil
+}
+
+func TestMarkSentRollsBack(t *testing.T) {
+	tests := []struct {
+		name          string
+		failOn        string
+		wantCommits   int
+		wantRollbacks int
+	}{
+		{
+			name:        "both statements succeed",
+			wantCommits: 1,
+		},
+		{
+			name:          "status update fails",
+			failOn:        "pd_updategetemailwisesend",
+			wantRollbacks: 1,
+		},
+		{
+			name:          "after-send procedure fails",
+			failOn:        "pd_aftersend",
+			wantRollbacks: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &txConnector{failOn: tt.failOn}
+			db := sql.OpenDB(c)
+			defer db.Close()
+
+			store := newSQLStore(db)
+			if err := store.setAfterSend("dbo.pd_aftersend"); err != nil {
+				t.Fatal(err)
+			}
+			err := store.MarkSent(context.Background(), &Message{ID: 1, TxnNo: "txn"})
+			if (err != nil) != (tt.failOn != "") {
+				t.Errorf("MarkSent() error = %v, want error %v", err, tt.failOn != "")
+			}
+			if c.commits != tt.wantCommits || c.rollbacks != tt.wantRollbacks {
+				t.Errorf("commits, rollbacks = %d, %d, want %d, %d", c.commits, c.rollbacks, tt.wantCommits, tt.wantRollbacks)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"go.uber.org/zap"
+)
+
+// runError is a failure of a dependency while preparing a message, e.g. the
+// database, rather than of the message itself. It stops the run and leaves
+// the messages queued instead of flagging them.
+type runError struct {
+	err error
+}
+
+func (e *runError) Error() string { return e.err.Error() }
+
+func (e *runError) Unwrap() error { return e.err }
+
+// SuppressionList holds the addresses mail must no longer be sent to, e.g.
+// after a hard bounce.
+type SuppressionList interface {
+	// Suppress adds addr to the list with the reason it was suppressed.
+	Suppress(ctx context.Context, addr, reason string) error
+	// Suppressed returns the addresses of addrs on the list.
+	Suppressed(ctx context.Context, addrs []string) (map[string]bool, error)
+}
+
+// sqlSuppressionList keeps the suppressed addresses, lowercased, in
+// dbo.tb_emailSuppression.
+type sqlSuppressionList struct {
+	db *sqlStore
+}
+
+func (l *sqlSuppressionList) Suppress(ctx context.Context, addr, reason string) error {
+	addr = strings.ToLower(addr)
+
+	suppressed, err := l.Suppressed(ctx, []string{addr})
+	if err != nil {
+		return err
+	}
+	if suppressed[addr] {
+		return nil
+	}
+
+	q, args := l.db.sb.Insert("dbo.tb_emailSuppression").
+		Columns("emailaddress", "reason", "createdat").
+		Values(addr, reason, sq.Expr("GETDATE()")).
+		MustSql()
+
+	if _, err := l.db.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("failed to insert tb_emailSuppression: %w", err)
+	}
+	return nil
+}
+
+func (l *sqlSuppressionList) Suppressed(ctx context.Context, addrs []string) (map[string]bool, error) {
+	suppressed := make(map[string]bool)
+	if len(addrs) == 0 {
+		return suppressed, nil
+	}
+
+	lower := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		lower = append(lower, strings.ToLower(addr))
+	}
+
+	q, args := l.db.sb.Select("emailaddress").
+		From("dbo.tb_emailSuppression").
+		Where(sq.Eq{"emailaddress": lower}).
+		MustSql()
+
+	rows, err := l.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tb_emailSuppression: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr string
+		if err := rows.Scan(&addr); err != nil {
+			return nil, fmt.Errorf("failed to scan tb_emailSuppression: %w", err)
+		}
+		suppressed[strings.ToLower(addr)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate tb_emailSuppression: %w", err)
+	}
+
+	result := make(map[string]bool)
+	for _, addr := range addrs {
+		if suppressed[strings.ToLower(addr)] {
+			result[addr] = true
+		}
+	}
+	return result, nil
+}
+
+// dropSuppressed removes the suppressed addresses from the recipients of
+// msg, failing when no To recipient is left. A failed lookup is returned
+// as a *runError, it says nothing about msg.
+func (s *Service) dropSuppressed(ctx context.Context, msg *Message) error {
+	if !s.features.Suppression {
+		return nil
+	}
+
+	all := append(append(append([]string{}, msg.ToAddresses...), msg.CCAddresses...), msg.BCCAddresses...)
+	suppressed, err := s.suppressions.Suppressed(ctx, all)
+	if err != nil {
+		return &runError{err: err}
+	}
+	if len(suppressed) == 0 {
+		return nil
+	}
+
+	keep := func(addrs []string) []string {
+		kept := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if !suppressed[addr] {
+				kept = append(kept, addr)
+			}
+		}
+		return kept
+	}
+	msg.ToAddresses = keep(msg.ToAddresses)
+	msg.CCAddresses = keep(msg.CCAddresses)
+	msg.BCCAddresses = keep(msg.BCCAddresses)
+
+	dropped := make([]string, 0, len(suppressed))
+	for addr := range suppressed {
+		dropped = append(dropped, addr)
+	}
+	s.zlog.Warn("dropping suppressed recipients",
+		zap.String("txnno", msg.TxnNo),
+		zap.Strings("recipients", dropped),
+	)
+
+	if !s.hasRecipients(msg) {
+		return fmt.Errorf("every recipient is suppressed: %s", strings.Join(dropped, ", "))
+	}
+	return nil
+}
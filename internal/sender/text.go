@@ -0,0 +1,254 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// renderText returns the plain-text alternative of the body of msg: the
+// content, converted from HTML unless it is plain text already, followed
+// by the text footer.
+func (s *Service) renderText(msg *Message) (string, error) {
+	content := msg.Content
+	if !msg.EscapeContent() {
+		content = htmlToText(content)
+	}
+
+	footer, err := msg.rule.footer.renderText(msg)
+	if err != nil {
+		return "", err
+	}
+	if footer == "" {
+		return content, nil
+	}
+	return content + "\n\n" + footer, nil
+}
+
+// blockElements start on a line of their own.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "table": true, "tr": true, "ul": true, "ol": true,
+	"li": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "blockquote": true, "pre": true, "hr": true,
+}
+
+// htmlToText converts an HTML fragment to readable plain text: tags are
+// dropped, blocks and line breaks become new lines, list items get a dash,
+// links keep their target and tables become aligned columns.
+func htmlToText(s string) string {
+	var b strings.Builder
+	// table is the outermost table being read, nil outside of one. Nested
+	// tables are flattened into the cell holding them.
+	var table *textTable
+	out := func() *strings.Builder {
+		if table != nil {
+			return table.out()
+		}
+		return &b
+	}
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	var href string
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// io.EOF or malformed markup, either way what was read so
+			// far is the text.
+			if table != nil {
+				b.WriteString("\n" + table.render() + "\n")
+			}
+			return tidyText(b.String())
+
+		case html.TextToken:
+			if skip > 0 {
+				break
+			}
+			w := out()
+			t := string(z.Text())
+			if len(t) > 0 && isSpace(t[0]) {
+				w.WriteByte(' ')
+			}
+			w.WriteString(strings.Join(strings.Fields(t), " "))
+			if len(t) > 0 && isSpace(t[len(t)-1]) {
+				w.WriteByte(' ')
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			end := tt == html.EndTagToken
+
+			switch {
+			case tag == "script" || tag == "style":
+				if end {
+					skip = max(skip-1, 0)
+				} else if tt == html.StartTagToken {
+					skip++
+				}
+			case tag == "table" && table == nil:
+				if !end {
+					table = new(textTable)
+				}
+			case tag == "table" && !end:
+				table.depth++
+			case tag == "table" && table.depth > 0:
+				table.depth--
+			case tag == "table":
+				b.WriteString("\n" + table.render() + "\n")
+				table = nil
+			case table != nil && table.depth == 0 && tag == "tr":
+				table.endRow()
+			case table != nil && table.depth == 0 && (tag == "td" || tag == "th"):
+				if end {
+					table.endCell()
+				} else {
+					table.startCell()
+				}
+			case table != nil && (tag == "td" || tag == "th"):
+				// A cell of a nested table, kept apart from the next one.
+				out().WriteString(" ")
+			case tag == "br":
+				out().WriteString("\n")
+			case tag == "a" && !end:
+				href = ""
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					if string(k) == "href" {
+						href = string(v)
+					}
+				}
+			case tag == "a" && end:
+				if href != "" && !strings.HasPrefix(href, "#") {
+					fmt.Fprintf(out(), " (%s)", href)
+				}
+				href = ""
+			case blockElements[tag]:
+				if end && (tag == "li" || tag == "tr") {
+					// The next item starts its own line already.
+					break
+				}
+				w := out()
+				w.WriteString("\n")
+				if tag == "li" && !end {
+					w.WriteString("- ")
+				}
+			}
+		}
+	}
+}
+
+// textTable collects the cells of an HTML table to write them as aligned
+// columns.
+type textTable struct {
+	rows [][]string
+	row  []string
+	// cell is the text of the cell being read, nil between cells.
+	cell *strings.Builder
+	// depth counts the tables nested in the current cell.
+	depth int
+	// discard swallows the text between cells, e.g. the whitespace
+	// between tags.
+	discard strings.Builder
+}
+
+func (t *textTable) out() *strings.Builder {
+	if t.cell == nil {
+		t.discard.Reset()
+		return &t.discard
+	}
+	return t.cell
+}
+
+func (t *textTable) startCell() {
+	t.endCell()
+	t.cell = new(strings.Builder)
+}
+
+// endCell adds the cell being read to the row, on a single line.
+func (t *textTable) endCell() {
+	if t.cell == nil {
+		return
+	}
+	t.row = append(t.row, strings.Join(strings.Fields(t.cell.String()), " "))
+	t.cell = nil
+}
+
+// endRow closes the row being read, if any. A <tr> ends the previous row
+// too, as its end tag is optional.
+func (t *textTable) endRow() {
+	t.endCell()
+	if len(t.row) > 0 {
+		t.rows = append(t.rows, t.row)
+	}
+	t.row = nil
+}
+
+// render returns the rows of t with every column padded to its widest
+// cell, two spaces apart.
+func (t *textTable) render() string {
+	t.endRow()
+
+	var widths []int
+	for _, row := range t.rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], textWidth(cell))
+		}
+	}
+
+	lines := make([]string, 0, len(t.rows))
+	for _, row := range t.rows {
+		var line strings.Builder
+		for i, cell := range row {
+			line.WriteString(cell)
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-textWidth(cell)+2))
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// textWidth returns the number of columns s takes in a monospace font: the
+// combining marks of e.g. Lao and Thai take none.
+func textWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.Is(unicode.Mn, r) {
+			n++
+		}
+	}
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// tidyText trims every line and keeps at most one blank line in a row.
+func tidyText(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank && len(out) > 0 {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		out = append(out, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
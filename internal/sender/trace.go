@@ -0,0 +1,45 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers carrying the W3C trace context of the send, for internal mail
+// whose receiving system continues the trace.
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+// traceContext is the W3C trace context of a message.
+type traceContext struct {
+	parent string
+	state  string
+}
+
+// traceContextOf returns the trace context of the span active in ctx, the
+// zero traceContext when there is none.
+func traceContextOf(ctx context.Context) traceContext {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return traceContext{}
+	}
+	return traceContext{
+		parent: fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags()),
+		state:  sc.TraceState().String(),
+	}
+}
+
+// setTraceHeaders writes tc to the headers of c, nothing when it is empty.
+func setTraceHeaders(c composer, tc traceContext) {
+	if tc.parent == "" {
+		return
+	}
+	c.SetHeader(traceparentHeader, tc.parent)
+	if tc.state != "" {
+		c.SetHeader(tracestateHeader, tc.state)
+	}
+}
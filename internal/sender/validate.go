@@ -0,0 +1,73 @@
+package sender
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// TemplateError is a template that failed to render with sample data.
+type TemplateError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// sampleMessage is the message templates are rendered with when validated.
+var sampleMessage = Message{
+	ID:           1,
+	TxnNo:        "TXN-SAMPLE",
+	RuleID:       "RULE-SAMPLE",
+	Time:         "2006-01-02",
+	Subject:      "Sample subject",
+	Content:      "<p>Sample content</p>",
+	Status:       StatusAdd,
+	ToAddresses:  []string{"to@example.com"},
+	BCCAddresses: []string{"bcc@example.com"},
+}
+
+// ValidateTemplates renders every active template with sample data, without
+// sending anything, and returns the ones that fail. The message templates
+// of MAIL_TEMPLATE_DIR are rendered with their <name>.sample.json.
+func (s *Service) ValidateTemplates(_ context.Context) []TemplateError {
+	type check struct {
+		name   string
+		render func(*Message) (string, error)
+	}
+
+	checks := []check{
+		{"MAIL_FOOTER_HTML", s.rules.Load().defaults.footer.renderHTML},
+		{"MAIL_FOOTER_TEXT", s.rules.Load().defaults.footer.renderText},
+		{"MAIL_BODY_WRAPPER", func(msg *Message) (string, error) {
+			return s.wrapper.render(msg, msg.Content)
+		}},
+	}
+	for _, id := range s.rules.Load().ids() {
+		f := s.rules.Load().resolve(id).footer
+		checks = append(checks,
+			check{"rule " + id + " footer_html", f.renderHTML},
+			check{"rule " + id + " footer_text", f.renderText},
+		)
+	}
+
+	broken := make([]TemplateError, 0)
+	for _, c := range checks {
+		msg := sampleMessage
+		if _, err := c.render(&msg); err != nil {
+			broken = append(broken, TemplateError{Name: c.name, Error: err.Error()})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(s.templates)) {
+		t := s.templates[name]
+		data := messageTemplateData{
+			TxnNo:  sampleMessage.TxnNo,
+			RuleID: sampleMessage.RuleID,
+			Date:   sampleMessage.Time,
+			Data:   t.sample,
+		}
+		if _, _, err := t.render(s.locale, data); err != nil {
+			broken = append(broken, TemplateError{Name: "template " + name, Error: err.Error()})
+		}
+	}
+	return broken
+}
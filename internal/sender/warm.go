@@ -0,0 +1,115 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// pinger is a connection that can tell whether the relay still holds it.
+type pinger interface {
+	Noop() error
+}
+
+// warmer keeps a connection of every SMTP pool open between the runs.
+type warmer struct {
+	interval time.Duration
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// StartWarmUp keeps an authenticated connection idle in every SMTP pool,
+// checked with a NOOP every SMTP_KEEP_WARM_INTERVAL and replaced when the
+// relay dropped it, so the first message of a run does not wait for the
+// TCP and TLS handshakes. It does nothing when the interval is 0. Close
+// stops it.
+func (s *Service) StartWarmUp(ctx context.Context) {
+	if s.warm.interval <= 0 {
+		return
+	}
+
+	ctx, s.warm.cancel = context.WithCancel(ctx)
+	for profile, d := range s.dialers {
+		p, ok := d.(*dialerPool)
+		if !ok {
+			continue
+		}
+
+		zlog := s.zlog.With(
+			zap.String("service", "sender"),
+			zap.String("method", "StartWarmUp"),
+			zap.String("smtp_profile", profile),
+		)
+		s.warm.wg.Add(1)
+		go func() {
+			defer s.warm.wg.Done()
+			p.keepWarm(ctx, zlog, s.warm.interval)
+		}()
+	}
+}
+
+// stop stops the warm-up and waits for it, so no connection is opened
+// after the pools are closed.
+func (w *warmer) stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.wg.Wait()
+}
+
+// keepWarm refreshes the warm connection of p every interval until ctx is
+// done.
+func (p *dialerPool) keepWarm(ctx context.Context, zlog *zap.Logger, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := p.refreshWarm(); err != nil {
+			zlog.Warn("failed to keep an smtp connection warm", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refreshWarm checks the last idle connection of p with a NOOP, replacing
+// it when the relay no longer answers, or dials one when none is idle. It
+// leaves p alone while every connection is in use.
+func (p *dialerPool) refreshWarm() error {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return nil
+	}
+	defer func() { <-p.sem }()
+
+	p.mu.Lock()
+	var conn *pooledConn
+	if n := len(p.idle); n > 0 {
+		conn = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		if pc, ok := conn.SendCloser.(pinger); ok && pc.Noop() == nil {
+			p.put(conn)
+			return nil
+		}
+		// Dead, or cannot be checked.
+		conn.Close()
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.put(conn)
+	return nil
+}
@@ -0,0 +1,114 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SendWindow is when the messages of a rule may be sent, e.g. office hours
+// for marketing mail. Messages queued outside of it wait for the next one:
+// they are not listed while it opens later the same day, and are moved to
+// the next day once it is closed for the rest of the day. An empty window
+// allows any time.
+type SendWindow struct {
+	// Start and End are local times of day as "15:04", End can be "24:00".
+	// A window ending before it starts runs over midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Days are the weekdays of the window, "mon" to "sun", every day when
+	// empty. For a window over midnight they are the days it starts.
+	Days []string `json:"days"`
+}
+
+// sendWindow is a parsed SendWindow, in minutes since midnight.
+type sendWindow struct {
+	start, end int
+	days       map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parse returns w parsed, nil for an empty window.
+func (w SendWindow) parse() (*sendWindow, error) {
+	if w.Start == "" && w.End == "" && len(w.Days) == 0 {
+		return nil, nil
+	}
+
+	start, err := parseTimeOfDay(w.Start, "00:00")
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window start: %w", err)
+	}
+	end, err := parseTimeOfDay(w.End, "24:00")
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window end: %w", err)
+	}
+
+	sw := &sendWindow{start: start, end: end}
+	if len(w.Days) > 0 {
+		sw.days = make(map[time.Weekday]bool, len(w.Days))
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("invalid send window day %q", d)
+			}
+			sw.days[wd] = true
+		}
+	}
+	return sw, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of v, "15:04" or
+// "24:00", or of def when v is empty.
+func parseTimeOfDay(v, def string) (int, error) {
+	if v == "" {
+		v = def
+	}
+	if v == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether messages may be sent at t. A nil window allows
+// any time.
+func (w *sendWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start <= w.end {
+		return w.onDay(day) && minute >= w.start && minute < w.end
+	}
+	// Over midnight: the evening belongs to today's window, the early
+	// hours to yesterday's.
+	if minute >= w.start {
+		return w.onDay(day)
+	}
+	return minute < w.end && w.onDay((day+6)%7)
+}
+
+// opensLater reports whether w, closed at t, opens again later the same
+// day. The messages of a window closed for the rest of the day are moved
+// to the next one.
+func (w *sendWindow) opensLater(t time.Time) bool {
+	return w.onDay(t.Weekday()) && t.Hour()*60+t.Minute() < w.start
+}
+
+func (w *sendWindow) onDay(d time.Weekday) bool {
+	return w.days == nil || w.days[d]
+}
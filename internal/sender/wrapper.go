@@ -0,0 +1,73 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+)
+
+// defaultBodyWrapper is the HTML the content of every mail is wrapped in
+// without MAIL_BODY_WRAPPER, in the Lao font of the original deployment.
+const defaultBodyWrapper = `<html><body style="font-family: Saysettha OT;">{{.Content}}</body></html>`
+
+// bodyWrapper is the HTML document the content of a mail is written into,
+// an html/template executed with a wrapperData.
+type bodyWrapper struct {
+	t *template.Template
+}
+
+// wrapperData is the data available to the wrapper template. Content is
+// the content of the message followed by its footer, already HTML, the
+// other fields are escaped where they are written.
+type wrapperData struct {
+	Content template.HTML
+	Subject string
+	RuleID  string
+	TxnNo   string
+	Locale  string
+}
+
+// newBodyWrapper parses the wrapper template, given as is or as the path
+// of a file holding it, defaultBodyWrapper when both are empty.
+func newBodyWrapper(text, path string) (*bodyWrapper, error) {
+	if text != "" && path != "" {
+		return nil, errors.New("MAIL_BODY_WRAPPER and MAIL_BODY_WRAPPER_FILE are exclusive")
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MAIL_BODY_WRAPPER_FILE: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		text = defaultBodyWrapper
+	}
+
+	t, err := template.New("wrapper.html").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MAIL_BODY_WRAPPER: %w", err)
+	}
+	return &bodyWrapper{t: t}, nil
+}
+
+// render writes content, the HTML content and footer of msg, into the
+// wrapper.
+func (w *bodyWrapper) render(msg *Message, content string) (string, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(content) + 128)
+
+	err := w.t.Execute(&buf, wrapperData{
+		Content: template.HTML(content),
+		Subject: msg.Subject,
+		RuleID:  msg.RuleID,
+		TxnNo:   msg.TxnNo,
+		Locale:  msg.Locale,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", w.t.Name(), err)
+	}
+	return buf.String(), nil
+}
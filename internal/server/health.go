@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Formats of the probe responses.
+const (
+	// HealthFormatJSON answers with the code, status, message and checks.
+	HealthFormatJSON = "json"
+	// HealthFormatText answers with a plain "OK" or "UNAVAILABLE" body,
+	// for the monitors that only match a string.
+	HealthFormatText = "text"
+)
+
+// Health serves the liveness and readiness probes. Only readiness pings
+// the database, retrying a failed ping so a one-off blip does not flap it:
+// a database outage takes the service out of rotation instead of getting
+// it restarted. The deep readiness probe also dials the SMTP relay.
+type Health struct {
+	db           *sql.DB
+	readyTimeout time.Duration
+	format       string
+
+	// The database is pinged up to dbAttempts times, dbBackoff apart, each
+	// ping within readyTimeout.
+	dbAttempts int
+	dbBackoff  time.Duration
+
+	// smtp checks the relay, nil disables the check.
+	smtp        func(ctx context.Context) error
+	smtpTimeout time.Duration
+}
+
+// NewHealth returns the probes answering in format, HealthFormatJSON when
+// it is unknown.
+func NewHealth(db *sql.DB, readyTimeout time.Duration, format string) *Health {
+	if format != HealthFormatText {
+		format = HealthFormatJSON
+	}
+
+	return &Health{
+		db:           db,
+		readyTimeout: readyTimeout,
+		format:       format,
+		dbAttempts:   1,
+	}
+}
+
+// SetDBRetry makes readiness ping the database up to attempts times,
+// waiting backoff between two pings.
+func (h *Health) SetDBRetry(attempts int, backoff time.Duration) {
+	h.dbAttempts = max(attempts, 1)
+	h.dbBackoff = backoff
+}
+
+// SetSMTPCheck makes the deep probes run check within timeout.
+func (h *Health) SetSMTPCheck(check func(ctx context.Context) error, timeout time.Duration) {
+	h.smtp = check
+	h.smtpTimeout = timeout
+}
+
+// Register mounts the probes on e. /v1/healthz is kept as the readiness
+// probe, ?deep=true or /v1/healthz/smtp also checks the relay.
+func (h *Health) Register(e *echo.Echo) {
+	e.GET("/v1/healthz", h.ready)
+	e.GET("/v1/healthz/ready", h.ready)
+	e.GET("/v1/healthz/live", h.live)
+	e.GET("/v1/healthz/smtp", h.deep)
+}
+
+// live only tells the process answers.
+func (h *Health) live(c echo.Context) error {
+	if h.format == HealthFormatText {
+		return c.String(http.StatusOK, "OK")
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"code":    http.StatusOK,
+		"status":  "OK",
+		"message": "Alive!",
+	})
+}
+
+func (h *Health) ready(c echo.Context) error {
+	deep, _ := strconv.ParseBool(c.QueryParam("deep"))
+	return h.check(c, h.readyTimeout, deep)
+}
+
+func (h *Health) deep(c echo.Context) error {
+	return h.check(c, h.readyTimeout, true)
+}
+
+type healthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Timeout   string  `json:"timeout"`
+	Error     string  `json:"error,omitempty"`
+	// Attempts is the number of database pings it took.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// runCheck runs fn within timeout and reports how it went.
+func runCheck(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := fn(ctx)
+	hc := healthCheck{
+		Status:    "OK",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Timeout:   timeout.String(),
+	}
+	if err != nil {
+		hc.Status = "UNAVAILABLE"
+		hc.Error = err.Error()
+	}
+	return hc
+}
+
+// pingDB pings the database until it answers or h.dbAttempts pings failed.
+func (h *Health) pingDB(ctx context.Context, timeout time.Duration) healthCheck {
+	for attempt := 1; ; attempt++ {
+		hc := runCheck(ctx, timeout, h.db.PingContext)
+		hc.Attempts = attempt
+		if hc.Status == "OK" || attempt >= h.dbAttempts {
+			return hc
+		}
+
+		select {
+		case <-ctx.Done():
+			return hc
+		case <-time.After(h.dbBackoff):
+		}
+	}
+}
+
+// check pings the database, and the relay when deep is set. Without the
+// database the service is unavailable, without the relay it is only
+// degraded: it still queues and answers, so the probe keeps passing.
+func (h *Health) check(c echo.Context, timeout time.Duration, deep bool) error {
+	db := h.pingDB(c.Request().Context(), timeout)
+	checks := echo.Map{"database": db}
+
+	if db.Status != "OK" {
+		if h.format == HealthFormatText {
+			return c.String(http.StatusServiceUnavailable, "UNAVAILABLE")
+		}
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"code":    http.StatusServiceUnavailable,
+			"status":  "UNAVAILABLE",
+			"message": "Unavailable!",
+			"checks":  checks,
+		})
+	}
+
+	if deep && h.smtp != nil {
+		smtp := runCheck(c.Request().Context(), h.smtpTimeout, h.smtp)
+		checks["smtp"] = smtp
+
+		if smtp.Status != "OK" {
+			if h.format == HealthFormatText {
+				return c.String(http.StatusOK, "DEGRADED")
+			}
+			return c.JSON(http.StatusOK, echo.Map{
+				"code":    http.StatusOK,
+				"status":  "DEGRADED",
+				"message": "The SMTP relay is unreachable.",
+				"checks":  checks,
+			})
+		}
+	}
+
+	if h.format == HealthFormatText {
+		return c.String(http.StatusOK, "OK")
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"code":    http.StatusOK,
+		"status":  "OK",
+		"message": "Available!",
+		"checks":  checks,
+	})
+}
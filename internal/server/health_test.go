@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// upConnector opens connections to a database that is always up.
+type upConnector struct{}
+
+func (upConnector) Connect(context.Context) (driver.Conn, error) {
+	return upConn{}, nil
+}
+
+func (upConnector) Driver() driver.Driver {
+	return nil
+}
+
+type upConn struct{}
+
+func (upConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (upConn) Close() error {
+	return nil
+}
+
+func (upConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transaction not supported")
+}
+
+func TestHealthDegradedWithoutRelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		smtpErr    error
+		wantStatus string
+	}{
+		{name: "relay up", format: HealthFormatJSON, wantStatus: "OK"},
+		{name: "relay down", format: HealthFormatJSON, smtpErr: errors.New("connection refused"), wantStatus: "DEGRADED"},
+		{name: "relay down as text", format: HealthFormatText, smtpErr: errors.New("connection refused"), wantStatus: "DEGRADED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := sql.OpenDB(upConnector{})
+			defer db.Close()
+
+			h := NewHealth(db, time.Second, tt.format)
+			h.SetSMTPCheck(func(context.Context) error { return tt.smtpErr }, time.Second)
+			e := echo.New()
+			h.Register(e)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/healthz?deep=true", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("code = %d, want %d so the probe keeps passing", rec.Code, http.StatusOK)
+			}
+
+			status := rec.Body.String()
+			if tt.format == HealthFormatJSON {
+				var body struct {
+					Status string `json:"status"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				status = body.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sendingemail/internal/sender"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	stdmw "github.com/labstack/echo/v4/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdminAuth returns a middleware that only lets through requests carrying
+// token as a bearer token. When token is empty every request is rejected,
+// so the admin routes stay closed until a token is configured.
+func AdminAuth(token string) echo.MiddlewareFunc {
+	return stdmw.KeyAuthWithConfig(stdmw.KeyAuthConfig{
+		Validator: func(key string, c echo.Context) (bool, error) {
+			if token == "" {
+				return false, nil
+			}
+			return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			return status.Error(codes.Unauthenticated, "Unauthorized.")
+		},
+	})
+}
+
+// Handler serves the sender admin routes.
+type Handler struct {
+	svc *sender.Service
+	// sendTimeout bounds a send run started over HTTP.
+	sendTimeout time.Duration
+}
+
+func NewHandler(svc *sender.Service, sendTimeout time.Duration) *Handler {
+	return &Handler{svc: svc, sendTimeout: sendTimeout}
+}
+
+// Register mounts the routes of h on g.
+func (h *Handler) Register(g *echo.Group) {
+	g.GET("/messages", h.listMessages)
+	g.GET("/messages/next-batch", h.nextBatch)
+	g.GET("/messages/:txnno/eml", h.getMessageEML)
+	g.GET("/messages/:txnno/events", h.messageEvents)
+	g.POST("/send", h.send)
+	g.GET("/send/stream", h.sendStream)
+	g.POST("/bounces", h.bounce)
+	g.POST("/messages/failed/requeue", h.requeueFailed)
+	g.POST("/sender/resume", h.resume)
+	g.GET("/templates/validate", h.validateTemplates)
+	g.GET("/config", h.config)
+	g.POST("/config/reload", h.reloadConfig)
+	g.GET("/smtp/greetings", h.relayGreetings)
+}
+
+// queuedMessage is the JSON view of a queued message, without its content.
+type queuedMessage struct {
+	TxnNo         string   `json:"txn_no"`
+	RuleID        string   `json:"rule_id"`
+	Time          string   `json:"time"`
+	Subject       string   `json:"subject"`
+	To            []string `json:"to"`
+	BCC           []string `json:"bcc"`
+	AttachmentURL string   `json:"attachment_url,omitempty"`
+	Priority      string   `json:"priority,omitempty"`
+	// From and ReplyTo are the overrides of the message, its rule decides
+	// without them.
+	From    string `json:"from,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Content is only filled on demand, it can hold personal data.
+	Content     string `json:"content,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func newQueuedMessage(m *sender.Message) queuedMessage {
+	return queuedMessage{
+		TxnNo:         m.TxnNo,
+		RuleID:        m.RuleID,
+		Time:          m.Time,
+		Subject:       m.Subject,
+		To:            m.ToAddresses,
+		BCC:           m.BCCAddresses,
+		AttachmentURL: m.AttachmentURL,
+		Priority:      m.Priority,
+		From:          m.From,
+		ReplyTo:       m.ReplyTo,
+	}
+}
+
+// Bounds of the limit query parameter of GET /messages.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+)
+
+// listMessages returns the queued messages, up to ?limit= of them. Their
+// content is left out unless ?full=true.
+func (h *Handler) listMessages(c echo.Context) error {
+	limit := defaultListLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return status.Errorf(codes.InvalidArgument, "Limit must be between 1 and %d.", maxListLimit)
+		}
+		limit = n
+	}
+	full, _ := strconv.ParseBool(c.QueryParam("full"))
+
+	messages, err := h.svc.ListMessages(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	total := len(messages)
+	messages = messages[:min(limit, total)]
+	views := make([]queuedMessage, 0, len(messages))
+	for _, m := range messages {
+		v := newQueuedMessage(m)
+		if full {
+			v.Content = m.Content
+			v.ContentType = m.ContentType
+		}
+		views = append(views, v)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"count":     len(views),
+		"truncated": total > len(views),
+		"messages":  views,
+	})
+}
+
+func (h *Handler) nextBatch(c echo.Context) error {
+	messages, err := h.svc.NextBatch(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	views := make([]queuedMessage, 0, len(messages))
+	for _, m := range messages {
+		views = append(views, newQueuedMessage(m))
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"count":    len(views),
+		"messages": views,
+	})
+}
+
+func (h *Handler) getMessageEML(c echo.Context) error {
+	txnNo := c.Param("txnno")
+
+	var buf bytes.Buffer
+	if err := h.svc.WriteEML(c.Request().Context(), txnNo, &buf); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(
+		echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", txnNo+".eml"),
+	)
+	return c.Blob(http.StatusOK, "message/rfc822", buf.Bytes())
+}
+
+func (h *Handler) messageEvents(c echo.Context) error {
+	txnNo := c.Param("txnno")
+
+	events, err := h.svc.MessageEvents(c.Request().Context(), txnNo)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"txn_no": txnNo,
+		"events": events,
+	})
+}
+
+type sendRequest struct {
+	TxnNos []string `json:"txn_nos"`
+}
+
+// send runs a send now, restricted to the txn_nos of the body when given.
+// It waits for a scheduled run in progress to finish, the service runs one
+// at a time.
+func (h *Handler) send(c echo.Context) error {
+	var req sendRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return status.Error(codes.InvalidArgument, "Invalid request body.")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), h.sendTimeout)
+	defer cancel()
+	runID := uuid.NewString()
+	ctx = sender.WithRunID(ctx, runID)
+
+	res, err := h.runSend(ctx, req.TxnNos)
+	if err != nil && (res == nil || len(res.Outcomes) == 0) {
+		return err
+	}
+	return c.JSON(http.StatusOK, sendSummary(runID, res, err))
+}
+
+// sendStream runs a send like send, restricted to the txn_no query
+// parameters when given, and streams the outcome of each message as a
+// "progress" Server-Sent Event, then the summary as a "done" event, or an
+// "error" event when the run could not start. The run goes on when the
+// client disconnects.
+func (h *Handler) sendStream(c echo.Context) error {
+	// The run outlives the request, only the send timeout bounds it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), h.sendTimeout)
+	defer cancel()
+	runID := uuid.NewString()
+	ctx = sender.WithRunID(ctx, runID)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Once the client is gone the writes fail, the events are dropped.
+	ctx = sender.WithProgress(ctx, func(o sender.MessageOutcome) {
+		writeEvent(w, "progress", o)
+	})
+	res, err := h.runSend(ctx, c.QueryParams()["txn_no"])
+	if err != nil && (res == nil || len(res.Outcomes) == 0) {
+		writeEvent(w, "error", echo.Map{"run_id": runID, "error": err.Error()})
+		return nil
+	}
+	writeEvent(w, "done", sendSummary(runID, res, err))
+	return nil
+}
+
+// writeEvent writes v as a Server-Sent Event of type event and flushes it.
+func writeEvent(w *echo.Response, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	w.Flush()
+}
+
+// runSend sends the messages with txnNos, or the whole queue without them.
+func (h *Handler) runSend(ctx context.Context, txnNos []string) (*sender.SendResult, error) {
+	if len(txnNos) > 0 {
+		return h.svc.SendTxnNos(ctx, txnNos)
+	}
+	return h.svc.Send(ctx)
+}
+
+// sendSummary returns the body describing res, the result of run runID
+// which ended with err.
+func sendSummary(runID string, res *sender.SendResult, err error) echo.Map {
+	body := echo.Map{
+		"run_id":      runID,
+		"listed":      res.Listed,
+		"processed":   res.Sent + res.Failed + res.Retried,
+		"sent":        res.Sent,
+		"failed":      res.Failed,
+		"retried":     res.Retried,
+		"skipped":     res.Skipped,
+		"flagged":     res.Flagged,
+		"quarantined": res.Quarantined,
+		"duplicates":  res.Duplicates,
+		"deferred":    res.Deferred,
+		"messages":    res.Outcomes,
+	}
+	if err != nil {
+		body["error"] = err.Error()
+	}
+	return body
+}
+
+// bounce receives the bounces reported by the relay webhook.
+func (h *Handler) bounce(c echo.Context) error {
+	var b sender.Bounce
+	if err := c.Bind(&b); err != nil {
+		return status.Error(codes.InvalidArgument, "Invalid request body.")
+	}
+
+	class, err := h.svc.HandleBounce(c.Request().Context(), b)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"recipient": b.Recipient,
+		"class":     class,
+	})
+}
+
+func (h *Handler) requeueFailed(c echo.Context) error {
+	n, err := h.svc.RequeueFailed(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"requeued": n,
+	})
+}
+
+func (h *Handler) resume(c echo.Context) error {
+	h.svc.Resume()
+	return c.JSON(http.StatusOK, echo.Map{
+		"code":    http.StatusOK,
+		"status":  "OK",
+		"message": "Sending resumed.",
+	})
+}
+
+func (h *Handler) validateTemplates(c echo.Context) error {
+	broken := h.svc.ValidateTemplates(c.Request().Context())
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok":     len(broken) == 0,
+		"broken": broken,
+	})
+}
+
+func (h *Handler) relayGreetings(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"greetings": h.svc.RelayGreetings(),
+	})
+}
+
+func (h *Handler) reloadConfig(c echo.Context) error {
+	changes, err := h.svc.ReloadRules(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"changes": changes,
+	})
+}
+
+func (h *Handler) config(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"features": h.svc.Features(),
+	})
+}
@@ -0,0 +1,76 @@
+// Package shutdown tears the components of the service down in the reverse
+// order they were started, within a shared deadline.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Func releases a component. It should return once ctx is done.
+type Func func(ctx context.Context) error
+
+type step struct {
+	name string
+	fn   Func
+}
+
+// Registry collects the cleanup funcs of the components as they start.
+type Registry struct {
+	zlog *zap.Logger
+
+	mu    sync.Mutex
+	steps []step
+}
+
+func New(zlog *zap.Logger) *Registry {
+	return &Registry{
+		zlog: zlog.With(zap.String("component", "shutdown")),
+	}
+}
+
+// Register adds fn to run on shutdown, before every func registered so
+// far: a component is torn down before the ones it was built on.
+func (r *Registry) Register(name string, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.steps = append(r.steps, step{name: name, fn: fn})
+}
+
+// RegisterCloser registers a component that stops with a Close method.
+func (r *Registry) RegisterCloser(name string, close func() error) {
+	r.Register(name, func(context.Context) error {
+		return close()
+	})
+}
+
+// Shutdown runs the registered funcs in reverse order with ctx as their
+// shared deadline. Every func runs even when an earlier one fails or the
+// deadline passed, the errors are joined. The funcs run once, later calls
+// return nil.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	steps := r.steps
+	r.steps = nil
+	r.mu.Unlock()
+
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+
+		start := time.Now()
+		if err := s.fn(ctx); err != nil {
+			r.zlog.Error("failed to stop component", zap.String("name", s.name), zap.Error(err))
+			errs = append(errs, fmt.Errorf("failed to stop %s: %w", s.name, err))
+			continue
+		}
+		r.zlog.Info("component stopped", zap.String("name", s.name), zap.Duration("took", time.Since(start)))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,7 @@
+-- Members of the group codes, e.g. "@finance-team", written in the address
+-- columns. Only read for the messages addressed to a group code.
+CREATE TABLE dbo.tb_emailGroupMember (
+    groupcode    VARCHAR(50)   NOT NULL,
+    emailaddress NVARCHAR(320) NOT NULL,
+    CONSTRAINT PK_tb_emailGroupMember PRIMARY KEY (groupcode, emailaddress)
+);
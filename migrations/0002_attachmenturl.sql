@@ -0,0 +1,2 @@
+-- URL of a file attached to the message. Read with the attachments feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD attachmenturl NVARCHAR(2048) NULL;
@@ -0,0 +1,5 @@
+-- Read and delivery receipts requested by the message. Read with the
+-- receipts feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD
+    readreceipt     BIT NULL,
+    deliveryreceipt BIT NULL;
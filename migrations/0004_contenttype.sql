@@ -0,0 +1,3 @@
+-- Content type of the message, text/html when empty. Read with the
+-- content_types feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD contenttype VARCHAR(100) NULL;
@@ -0,0 +1,8 @@
+-- When the message was claimed for sending and how many times it was.
+-- Required: every send run writes them.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD
+    sendingat DATETIME NULL,
+    attempts  INT      NULL;
+
+CREATE INDEX IX_tb_getEmailWiseSend_rectype_sendingat
+    ON dbo.tb_getEmailWiseSend (rectype, sendingat);
@@ -0,0 +1,3 @@
+-- Amount of the transaction, for the CC thresholds of the rules. Read with
+-- the amounts feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD amount DECIMAL(18, 2) NULL;
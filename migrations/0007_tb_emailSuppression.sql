@@ -0,0 +1,8 @@
+-- Addresses mail must no longer be sent to, lowercased, e.g. after a hard
+-- bounce. Read and written with the suppression feature.
+CREATE TABLE dbo.tb_emailSuppression (
+    emailaddress NVARCHAR(320) NOT NULL,
+    reason       NVARCHAR(MAX) NULL,
+    createdat    DATETIME      NOT NULL,
+    CONSTRAINT PK_tb_emailSuppression PRIMARY KEY (emailaddress)
+);
@@ -0,0 +1,8 @@
+-- Last TWID processed by the resumable jobs, e.g. requeue-failed. Required
+-- by POST /v1/messages/failed/requeue.
+CREATE TABLE dbo.tb_emailCursor (
+    jobtype   VARCHAR(50) NOT NULL,
+    lasttwid  BIGINT      NOT NULL,
+    updatedat DATETIME    NOT NULL,
+    CONSTRAINT PK_tb_emailCursor PRIMARY KEY (jobtype)
+);
@@ -0,0 +1,3 @@
+-- Locale the message is rendered in, e.g. th-TH. Read with the locales
+-- feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD locale VARCHAR(35) NULL;
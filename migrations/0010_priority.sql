@@ -0,0 +1,3 @@
+-- Priority level of the message: HIGH, NORMAL or LOW. Read and sorted on
+-- with the priorities feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD priority VARCHAR(10) NULL;
@@ -0,0 +1,12 @@
+-- Timeline of the state transitions of the messages. Required: every send
+-- run appends to it.
+CREATE TABLE dbo.email_events (
+    eventid   BIGINT IDENTITY(1, 1) NOT NULL,
+    txnno     VARCHAR(50)   NOT NULL,
+    eventtype VARCHAR(20)   NOT NULL,
+    detail    NVARCHAR(MAX) NULL,
+    createdat DATETIME      NOT NULL,
+    CONSTRAINT PK_email_events PRIMARY KEY (eventid)
+);
+
+CREATE INDEX IX_email_events_txnno ON dbo.email_events (txnno, createdat);
@@ -0,0 +1,3 @@
+-- From address overriding the one of the rule. Read with the
+-- from_overrides feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD fromaddress NVARCHAR(320) NULL;
@@ -0,0 +1,13 @@
+-- Files attached to the messages, stored inline or as a path. Read with the
+-- attachments feature.
+CREATE TABLE dbo.tb_emailAttachment (
+    attachmentid BIGINT IDENTITY(1, 1) NOT NULL,
+    txnno        VARCHAR(50)    NOT NULL,
+    filename     NVARCHAR(255)  NULL,
+    contenttype  VARCHAR(100)   NULL,
+    content      VARBINARY(MAX) NULL,
+    filepath     NVARCHAR(1024) NULL,
+    CONSTRAINT PK_tb_emailAttachment PRIMARY KEY (attachmentid)
+);
+
+CREATE INDEX IX_tb_emailAttachment_txnno ON dbo.tb_emailAttachment (txnno);
@@ -0,0 +1,7 @@
+-- Messages sent per recipient and day. Required with RECIPIENT_DAILY_CAP.
+CREATE TABLE dbo.tb_emailRecipientDaily (
+    emailaddress NVARCHAR(320) NOT NULL,
+    sentdate     DATE          NOT NULL,
+    sentcount    INT           NOT NULL,
+    CONSTRAINT PK_tb_emailRecipientDaily PRIMARY KEY (emailaddress, sentdate)
+);
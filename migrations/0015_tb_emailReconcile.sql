@@ -0,0 +1,10 @@
+-- Messages delivered but not marked as sent, for an operator to reconcile.
+-- Required: ReapStuck leaves the messages listed here alone.
+CREATE TABLE dbo.tb_emailReconcile (
+    twid      BIGINT        NOT NULL,
+    txnno     VARCHAR(50)   NOT NULL,
+    reason    NVARCHAR(MAX) NULL,
+    createdat DATETIME      NOT NULL
+);
+
+CREATE INDEX IX_tb_emailReconcile_twid ON dbo.tb_emailReconcile (twid);
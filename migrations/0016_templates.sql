@@ -0,0 +1,5 @@
+-- Template the message is rendered from and its JSON data. Read with the
+-- templates feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD
+    templatename VARCHAR(100)  NULL,
+    templatedata NVARCHAR(MAX) NULL;
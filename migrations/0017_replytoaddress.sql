@@ -0,0 +1,3 @@
+-- Reply-To address overriding the one of the rule. Read with the
+-- from_overrides feature.
+ALTER TABLE dbo.tb_getEmailWiseSend ADD replytoaddress NVARCHAR(320) NULL;